@@ -4,6 +4,7 @@ import (
 	"cloud.google.com/go/firestore"
 	"context"
 	"fmt"
+	"reflect"
 	"time"
 )
 
@@ -19,43 +20,65 @@ type WriteBatchImpl struct {
 	batch   *firestore.WriteBatch
 	client *firestore.Client
 	cache   *FirestoreCache
-	logger  Logger
+	logger  StructuredLogger
 	updates []*KeyAndData
 	deletes []*Key
 	matadatas map[string]*Key
+	changes []*batchChange
+	// Create・Setで発生した最初のエラー (Commit時に返す)
+	err error
+	// 設定されている場合はCommit時にInterceptorを通る
+	foon *Foon
+}
+
+/** バッチ内の書き込み (クエリキャッシュの無効化に使う) */
+type batchChange struct {
+	key    *Key
+	data   interface{}
+	create bool
 }
 
 func (b *WriteBatchImpl) Create(data interface{}) WriteBatch {
-	return b.put(data, func(doc *firestore.DocumentRef, data interface{}) {
+	return b.put(data, true, func(doc *firestore.DocumentRef, data interface{}) {
 		b.batch.Create(doc, data)
 	})
 }
 
 func (b *WriteBatchImpl) Set(data interface{}, opts ...firestore.SetOption) WriteBatch {
-	return b.put(data, func(doc *firestore.DocumentRef, data interface{}) {
+	return b.put(data, false, func(doc *firestore.DocumentRef, data interface{}) {
 		b.batch.Set(doc, data, opts...)
 	})
-	return b
 }
 
-func (b *WriteBatchImpl) put(data interface{}, fn func(doc *firestore.DocumentRef, data interface{})) WriteBatch {
+func (b *WriteBatchImpl) put(data interface{}, create bool, fn func(doc *firestore.DocumentRef, data interface{})) WriteBatch {
+	if b.err != nil {
+		return b
+	}
 	info, err := newFields(data)
 	if err != nil {
-		b.logger.Warning(fmt.Sprintf("failed to create Fields (reason: %v)", err))
-		panic("invalid interface")
+		b.logger.Warn(fmt.Sprintf("failed to create Fields (reason: %v)", err))
+		b.err = err
+		return b
 	}
 	key := newKey(info)
+	create = create || !info.HasUniqueID()
 	if info.HasUniqueID() {
 		info.UpdateTime(time.Now())
 		fn(key.CreateDocumentRef(b.client), data)
 	} else {
 		ref := key.CreateCollectionRef(b.client).NewDoc()
-		info.UpdateField(ref.ID, time.Now())
+		if err := info.UpdateField(ref.ID, time.Now()); err != nil {
+			b.logger.Warn(fmt.Sprintf("failed to set id (reason: %v)", err))
+			b.err = err
+			return b
+		}
+		key.ID = ref.ID
 		fn(ref, data)
 	}
 
 	b.matadatas[key.CollectionPath()] = key
 	b.updates = append(b.updates, &KeyAndData{key, data})
+	b.changes = append(b.changes, &batchChange{key, data, create})
 	return b
 }
 
@@ -63,14 +86,42 @@ func (b *WriteBatchImpl) Delete(key *Key, opts ...firestore.Precondition) WriteB
 	b.batch.Delete(key.CreateDocumentRef(b.client), opts...)
 	b.deletes = append(b.deletes, key)
 	b.matadatas[key.CollectionPath()] = key
+	b.changes = append(b.changes, &batchChange{key, nil, false})
 	return b
 }
 
 func (b *WriteBatchImpl) Commit() error {
-	if _ , err := b.batch.Commit(b.context); err != nil {
+	if b.err != nil {
+		return b.err
+	}
+	if b.foon == nil {
+		return b.commit(b.context)
+	}
+	keys := []*Key{}
+	for _, change := range b.changes {
+		keys = append(keys, change.key)
+	}
+	return b.foon.intercept(&Operation{Kind: BatchOperation, Keys: keys}, func(f *Foon) error {
+		return b.commit(f.Context)
+	})
+}
+
+func (b *WriteBatchImpl) commit(ctx context.Context) error {
+	changes := b.entityChanges()
+
+	if _ , err := b.batch.Commit(ctx); err != nil {
 		return err
 	}
 
+	for _, update := range b.updates {
+		b.cache.countFirestore(update.Key.Collection, 0, 1, 0)
+		b.cache.countIndexEntries(update.Src)
+	}
+	for _, key := range b.deletes {
+		b.cache.countFirestore(key.Collection, 0, 0, 1)
+		b.cache.metrics.invalidated(key.Collection, 1)
+	}
+
 	if len(b.updates) > 0 {
 		b.cache.PutMulti(b.updates)
 	}
@@ -79,13 +130,46 @@ func (b *WriteBatchImpl) Commit() error {
 		b.cache.DeleteMulti(b.deletes)
 	}
 
-	for _, key := range b.matadatas {
-		metadata := LoadMetadata(b.cache, key)
-		metadata.DeleteAll()
-
-		group := LoadGroupMetaData(b.cache, key)
-		group.DeleteAll()
+	for path, key := range b.matadatas {
+		invalidateQueries(b.cache, key, changes[path])
 	}
 
 	return nil
 }
+
+/** 書き込み前のエンティティをキャッシュから取得し、コレクション毎の変更にまとめる */
+func (b *WriteBatchImpl) entityChanges() map[string][]entityChange {
+	caches := map[string]*CacheResult{}
+	for _, change := range b.changes {
+		if change.create || change.data == nil || !change.key.HasUniqueID() {
+			continue
+		}
+		old := reflect.New(reflect.Indirect(reflect.ValueOf(change.data)).Type()).Interface()
+		caches[InstanceCache.CreateURIByKey(change.key).URI()] = &CacheResult{change.key, old, false}
+	}
+	if len(caches) > 0 {
+		if err := b.cache.GetMulti(caches); err != nil && NoSuchDocument.IsNot(err) {
+			b.logger.Warn(fmt.Sprintf("failed to load caches (reason: %v)", err))
+		}
+	}
+
+	results := map[string][]entityChange{}
+	for _, change := range b.changes {
+		path := change.key.CollectionPath()
+		switch {
+		case change.create:
+			results[path] = append(results[path], entityChange{nil, change.data, true})
+		case change.data == nil:
+			// 削除時は型が分からないので変更前の値は不明とする
+			results[path] = append(results[path], entityChange{nil, nil, false})
+		default:
+			cache, ok := caches[InstanceCache.CreateURIByKey(change.key).URI()]
+			if ok && cache.HasCache {
+				results[path] = append(results[path], entityChange{cache.Src, change.data, true})
+			} else {
+				results[path] = append(results[path], entityChange{nil, change.data, false})
+			}
+		}
+	}
+	return results
+}
@@ -0,0 +1,23 @@
+package foon
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWriteBatch_不正な値はpanicせずCommitでエラーを返す(t *testing.T) {
+	s := newFakeStore(t, &fakeFirestoreServer{})
+	batch, err := s.Batch()
+	assert.NoError(t, err)
+
+	assert.NotPanics(t, func() {
+		batch.Create(&testNoID{Name: "foo"})
+		batch.Set(&testUnexportedID{})
+		batch.Create(&testNoID{Name: "bar"})
+	})
+	assert.Error(t, batch.Commit())
+
+	impl := batch.(*WriteBatchImpl)
+	assert.Len(t, impl.updates, 1)
+	assert.NotEmpty(t, impl.updates[0].Key.ID)
+}
@@ -1,10 +1,7 @@
 package foon
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"fmt"
 	"google.golang.org/appengine/memcache"
 	"time"
 	)
@@ -12,7 +9,16 @@ import (
 /** Memcacheを扱う */
 type FirestoreCache struct {
 	context.Context
-	logger Logger
+	logger StructuredLogger
+	local  *LocalCache
+	codec  Codec
+	// この値より大きいエントリは圧縮する (0以下の場合は圧縮しない)
+	compressThreshold int
+	// 設定されている場合はエントリを暗号化する
+	keys    KeyProvider
+	breaker *CircuitBreaker
+	metrics *Metrics
+	summary *requestSummary
 }
 
 /** キャッシュを取得する際の結果 */
@@ -23,7 +29,40 @@ type CacheResult struct {
 }
 
 func NewCache(ctx context.Context, logger Logger) *FirestoreCache {
-	return &FirestoreCache{ctx, logger}
+	return newCache(ctx, legacyLogger{logger})
+}
+
+func newCache(ctx context.Context, logger StructuredLogger) *FirestoreCache {
+	return &FirestoreCache{ctx, logger, nil, GobCodec{}, defaultCompressThreshold, nil, defaultCircuitBreaker, defaultMetrics, newRequestSummary()}
+}
+
+/** 書き込み時に使うCodecを設定する (読み込み時はエントリのヘッダーから選ぶ) */
+func (c *FirestoreCache) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+func (c *FirestoreCache) SetCircuitBreaker(breaker *CircuitBreaker) {
+	c.breaker = breaker
+}
+
+/** 統計の記録先を設定する (nilの場合は記録しない) */
+func (c *FirestoreCache) SetMetrics(metrics *Metrics) {
+	c.metrics = metrics
+}
+
+/** エントリを暗号化する鍵を設定する (nilの場合は暗号化しない) */
+func (c *FirestoreCache) SetKeyProvider(keys KeyProvider) {
+	c.keys = keys
+}
+
+/** 圧縮するエントリのサイズを設定する (0以下の場合は圧縮しない) */
+func (c *FirestoreCache) SetCompressThreshold(threshold int) {
+	c.compressThreshold = threshold
+}
+
+/** プロセス内のキャッシュを設定する (nilの場合は使わない) */
+func (c *FirestoreCache) SetLocalCache(local *LocalCache) {
+	c.local = local
 }
 
 func (c *FirestoreCache) GetEntity(src interface{}) error {
@@ -38,45 +77,235 @@ func (c *FirestoreCache) Get(info *Key, src interface{}) error {
 	if info.HasUniqueID() == false {
 		return InvalidId
 	}
-	return c.GetCache(InstanceCache.CreateURIByKey(info).URI(), src)
+	path := InstanceCache.CreateURIByKey(info).URI()
+	if c.local != nil {
+		if data, ok := c.local.get(c, info.Collection, path); ok {
+			c.logger.Debug("local cache is hit", F("path", path), F("hit", true))
+			if err := c.asValue(path, data, src); err == nil {
+				return nil
+			}
+			c.local.remove(path)
+		}
+	}
+	data, err := c.getItem(path)
+	if err != nil {
+		return err
+	}
+	if err := c.decode(path, data, src); err != nil {
+		return err
+	}
+	if c.local != nil {
+		c.local.set(info.Collection, path, data)
+	}
+	return nil
 }
 
 func (c *FirestoreCache) GetCache(path string, src interface{}) error {
-	c.logger.Trace(fmt.Sprintf("try to get memcache (path: %s)", path))
-	if cache, err := memcache.Get(c, path); err == nil && cache != nil {
-		c.logger.Trace(fmt.Sprintf("cache is hit (path: %s)", path))
-		err := c.asValue(cache.Value, src)
-		if err != nil {
-			c.logger.Warning(fmt.Sprintf("failed to get cache (reason: %v)", err))
+	data, err := c.getItem(path)
+	if err != nil {
+		return err
+	}
+	return c.decode(path, data, src)
+}
+
+/**
+ * デコードできないエントリは削除し、キャッシュミスとして扱う
+ * 構造体の定義が異なるエントリは並行して動いている別のバージョンのものなので、削除せずにキャッシュミスとして扱う。
+ */
+func (c *FirestoreCache) decode(path string, data []byte, src interface{}) error {
+	err := c.asValue(path, data, src)
+	if err == errSchemaMismatch {
+		c.logger.Debug("cache schema is mismatched", F("path", path))
+		return NoSuchDocument
+	}
+	if err != nil {
+		c.logger.Warn("failed to decode cache. evict it", F("path", path), F("reason", err))
+		c.deleteItems([]string{path})
+		return NoSuchDocument
+	}
+	return nil
+}
+
+/** キャッシュを使ってよいか (使える場合はリトライキューに残っているキーを先に削除する) */
+func (c *FirestoreCache) allow() bool {
+	if !c.breaker.allow() {
+		return false
+	}
+	c.breaker.retry(c)
+	return true
+}
+
+func (c *FirestoreCache) getItem(path string) ([]byte, error) {
+	data, err := c.lookupItem(path)
+	if err == errCacheUnavailable {
+		return nil, NoSuchDocument
+	}
+	return data, err
+}
+
+/** getItemと同じだが、Memcacheが使えなかった場合はキャッシュミスと区別してerrCacheUnavailableを返す */
+func (c *FirestoreCache) lookupItem(path string) ([]byte, error) {
+	if !c.allow() {
+		return nil, errCacheUnavailable
+	}
+	c.logger.Debug("try to get memcache", F("path", path))
+	cache, err := memcache.Get(c, memcacheKey(path))
+	if c.breaker.record(err) {
+		c.logger.Warn("failed to get memcache", F("path", path), F("reason", err))
+		return nil, errCacheUnavailable
+	}
+	if err == nil && cache != nil {
+		c.logger.Debug("cache is hit", F("path", path), F("hit", true))
+		if isChunkManifest(cache.Value) {
+			return c.readChunks(path, cache.Value)
+		}
+		return cache.Value, nil
+	}
+	return nil, NoSuchDocument
+}
+
+func (c *FirestoreCache) getItems(keys []string) (map[string][]byte, error) {
+	if !c.allow() {
+		return nil, NoSuchDocument
+	}
+	paths := map[string]string{}
+	memcacheKeys := []string{}
+	for _, key := range keys {
+		hashed := memcacheKey(key)
+		paths[hashed] = key
+		memcacheKeys = append(memcacheKeys, hashed)
+	}
+	caches, err := memcache.GetMulti(c, memcacheKeys)
+	if c.breaker.record(err) {
+		c.logger.Warn("failed to get memcaches", F("reason", err))
+	}
+	if err != nil {
+		return nil, NoSuchDocument
+	}
+	results := map[string][]byte{}
+	for key, item := range caches {
+		if isChunkManifest(item.Value) {
+			data, err := c.readChunks(paths[key], item.Value)
+			if err != nil {
+				continue
+			}
+			results[paths[key]] = data
+			continue
+		}
+		results[paths[key]] = item.Value
+	}
+	return results, nil
+}
+
+/**
+ * キャッシュへの書き込みは失敗してもエラーにしない (キャッシュが使えなくてもFirestoreへの書き込みは成功しているため)
+ * 書き込めなかったキーは古い値が残らないようにリトライキューに入れて削除する。
+ */
+func (c *FirestoreCache) setItems(items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, memcacheKey(item.Key))
+	}
+	if c.local != nil {
+		for _, item := range items {
+			c.local.update(item.Key, item.Value)
 		}
+	}
+	if !c.allow() {
+		c.breaker.enqueue(keys)
+		return nil
+	}
+	items, err := splitChunks(items)
+	if err != nil {
+		c.breaker.enqueue(keys)
 		return err
 	}
-	return NoSuchDocument
+	for _, item := range items {
+		item.Key = memcacheKey(item.Key)
+	}
+	if len(items) == 1 {
+		err = memcache.Set(c, items[0])
+	} else {
+		err = memcache.SetMulti(c, items)
+	}
+	if c.breaker.record(err) {
+		c.logger.Warn("failed to set memcache. delete it later", F("reason", err))
+		c.breaker.enqueue(keys)
+	}
+	return nil
+}
+
+/** 削除に失敗したキーはリトライキューに入れる */
+func (c *FirestoreCache) deleteItems(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if c.local != nil {
+		c.local.remove(keys...)
+	}
+	memcacheKeys := []string{}
+	for _, key := range keys {
+		memcacheKeys = append(memcacheKeys, memcacheKey(key))
+	}
+	if !c.allow() {
+		c.breaker.enqueue(memcacheKeys)
+		return nil
+	}
+
+	var err error
+	if len(memcacheKeys) == 1 {
+		err = memcache.Delete(c, memcacheKeys[0])
+	} else {
+		err = memcache.DeleteMulti(c, memcacheKeys)
+	}
+	if c.breaker.record(err) {
+		c.logger.Warn("failed to delete memcache. retry later", F("reason", err))
+		c.breaker.enqueue(memcacheKeys)
+	}
+	return nil
 }
 
 func (c *FirestoreCache) GetMulti(results map[string]*CacheResult) error {
-	c.logger.Trace(fmt.Sprintf("try to get memcaches"))
+	c.logger.Debug("try to get memcaches")
 	keys := []string{}
 	for key, val := range results {
-		keys = append(keys, key)
 		val.HasCache = false
-	}
-
-	if caches, err := memcache.GetMulti(c, keys); err == nil {
-		for _, item := range caches {
-			if m, ok := results[item.Key]; ok {
-				c.logger.Trace(fmt.Sprintf("cache is hit (%s)", item.Key))
-				err := c.asValue(item.Value, m.Src)
-				if err != nil {
-					c.logger.Warning(fmt.Sprintf("failed to get cache (reason: %v)", err))
-					return err
+		if c.local != nil {
+			if data, ok := c.local.get(c, val.Key.Collection, key); ok {
+				c.logger.Debug("local cache is hit", F("path", key), F("hit", true))
+				if err := c.asValue(key, data, val.Src); err == nil {
+					val.HasCache = true
+					continue
 				}
-				m.HasCache = true
+				c.local.remove(key)
 			}
 		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
 		return nil
 	}
-	return NoSuchDocument
+
+	caches, err := c.getItems(keys)
+	if err != nil {
+		return err
+	}
+	for key, data := range caches {
+		if m, ok := results[key]; ok {
+			c.logger.Debug("cache is hit", F("path", key), F("hit", true))
+			if err := c.decode(key, data, m.Src); err != nil {
+				continue
+			}
+			if c.local != nil {
+				c.local.set(m.Key.Collection, key, data)
+			}
+			m.HasCache = true
+		}
+	}
+	return nil
 }
 
 func (c *FirestoreCache) PutEntity(src interface{}) error {
@@ -91,43 +320,72 @@ func (c *FirestoreCache) Put(info *Key, src interface{}) error {
 	if info.HasUniqueID() == false {
 		return InvalidId
 	}
-	return c.PutCache(InstanceCache.CreateURIByKey(info).URI(), src)
+	normalized, ok := normalizeForCache(src)
+	if !ok {
+		// 保存後の値がサーバー側で決まるのでキャッシュしない
+		if err := c.Delete(info); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	}
+	return c.putItem(info.Collection, InstanceCache.CreateURIByKey(info).URI(), normalized)
 }
 
 func (c *FirestoreCache) PutMulti(results []*KeyAndData) error {
 	items := []*memcache.Item{}
+	deletes := []*Key{}
 
 	for _, res := range results {
-		bytes, err := c.asByte(res.Src)
+		normalized, ok := normalizeForCache(res.Src)
+		if !ok {
+			deletes = append(deletes, res.Key)
+			continue
+		}
+		path := InstanceCache.CreateURIByKey(res.Key).URI()
+		bytes, err := c.asByte(path, normalized)
 		if err != nil {
 			return err
 		}
+		c.metrics.encoded(res.Key.Collection, len(bytes))
 		items = append(items, &memcache.Item{
-			Key:        InstanceCache.CreateURIByKey(res.Key).URI(),
+			Key:        path,
 			Value:      bytes,
 			Expiration: time.Hour * 24 * 5,
 		})
 	}
 
-	if len(items) > 0 {
-		return memcache.SetMulti(c, items)
+	if len(deletes) > 0 {
+		c.DeleteMulti(deletes)
 	}
-
-	return nil
+	return c.setItems(items)
 }
 
 func (c *FirestoreCache) PutCache(path string, src interface{}) error {
-	bytes, err := c.asByte(src)
+	bytes, err := c.asByte(path, src)
 	if err != nil {
 		return err
 	}
+	return c.putBytes(path, bytes)
+}
+
+/** 統計にエンコードしたサイズを記録して保存する */
+func (c *FirestoreCache) putItem(collection string, path string, src interface{}) error {
+	bytes, err := c.asByte(path, src)
+	if err != nil {
+		return err
+	}
+	c.metrics.encoded(collection, len(bytes))
+	return c.putBytes(path, bytes)
+}
+
+func (c *FirestoreCache) putBytes(path string, bytes []byte) error {
 	tracef(c.logger, "save to memcache (key: %s)", path)
 
-	return memcache.Set(c, &memcache.Item{
+	return c.setItems([]*memcache.Item{{
 		Key:        path,
 		Value:      bytes,
 		Expiration: time.Hour * 24 * 5,
-	})
+	}})
 }
 
 func (c *FirestoreCache) Delete(info *Key) error {
@@ -135,8 +393,8 @@ func (c *FirestoreCache) Delete(info *Key) error {
 		return nil
 	}
 	url := InstanceCache.CreateURIByKey(info).URI()
-	c.logger.Trace(fmt.Sprintf("delete cache (key: %s)", url))
-	return memcache.Delete(c, url)
+	c.logger.Debug("delete cache", F("path", url))
+	return c.deleteItems([]string{url})
 }
 
 func (c *FirestoreCache) DeleteMulti(keys []*Key) error {
@@ -144,24 +402,9 @@ func (c *FirestoreCache) DeleteMulti(keys []*Key) error {
 	for _, key := range keys {
 		deleteKeys = append(deleteKeys, InstanceCache.CreateURIByKey(key).URI())
 	}
-	return memcache.DeleteMulti(c, deleteKeys)
+	return c.deleteItems(deleteKeys)
 }
 
 func (c *FirestoreCache) DeleteCache(path string) error {
-	return memcache.Delete(c, path)
-}
-
-func (c *FirestoreCache) asByte(src interface{}) ([]byte, error) {
-	buf := bytes.NewBuffer(nil)
-	err := gob.NewEncoder(buf).Encode(src)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func (c *FirestoreCache) asValue(data []byte, src interface{}) error {
-	buf := bytes.NewBuffer(data)
-	decoder := gob.NewDecoder(buf)
-	return decoder.Decode(src)
+	return c.deleteItems([]string{path})
 }
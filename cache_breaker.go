@@ -0,0 +1,163 @@
+package foon
+
+import (
+	"errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/** 削除に失敗したキーを保持する上限 */
+const maxRetryInvalidations = 10000
+
+/** サーキットブレーカーが開いているか、Memcacheの障害でキャッシュを読めなかった */
+var errCacheUnavailable = errors.New("memcache is unavailable")
+
+/**
+ * Memcacheの障害時にキャッシュを使わないようにするサーキットブレーカー
+ * 連続してthreshold回失敗すると、cooldownの間キャッシュを使わない (読み込みはミス、書き込みはスキップ)。
+ * 削除・書き込みに失敗したキーはリトライキューに入れ、Memcacheが復旧した後の最初の呼び出しで削除する。
+ * 複数のリクエストで共有するため、パッケージ変数などで1つだけ作成して使う。
+ */
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	retries   []string
+
+	errors         int64
+	skipped        int64
+	opened         int64
+	retryQueued    int64
+	retrySucceeded int64
+	retryDropped   int64
+}
+
+/** キャッシュの障害に関する統計 */
+type CacheHealthStats struct {
+	Open           bool
+	Errors         int64
+	Skipped        int64
+	Opened         int64
+	RetryPending   int64
+	RetryQueued    int64
+	RetrySucceeded int64
+	RetryDropped   int64
+}
+
+var defaultCircuitBreaker = NewCircuitBreaker(5, 30*time.Second)
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		retries:   []string{},
+	}
+}
+
+/** 既定のサーキットブレーカー (SetCircuitBreakerで変更しない限り全てのFoonで共有する) */
+func DefaultCircuitBreaker() *CircuitBreaker {
+	return defaultCircuitBreaker
+}
+
+func (b *CircuitBreaker) Stats() CacheHealthStats {
+	b.mu.Lock()
+	open := time.Now().Before(b.openUntil)
+	pending := int64(len(b.retries))
+	b.mu.Unlock()
+	return CacheHealthStats{
+		Open:           open,
+		Errors:         atomic.LoadInt64(&b.errors),
+		Skipped:        atomic.LoadInt64(&b.skipped),
+		Opened:         atomic.LoadInt64(&b.opened),
+		RetryPending:   pending,
+		RetryQueued:    atomic.LoadInt64(&b.retryQueued),
+		RetrySucceeded: atomic.LoadInt64(&b.retrySucceeded),
+		RetryDropped:   atomic.LoadInt64(&b.retryDropped),
+	}
+}
+
+/** キャッシュを使ってよいか (使わない場合はスキップした数を数える) */
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		atomic.AddInt64(&b.skipped, 1)
+		return false
+	}
+	return true
+}
+
+/** Memcacheの結果を記録する (障害の場合はtrueを返す) */
+func (b *CircuitBreaker) record(err error) bool {
+	failed := isCacheFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return false
+	}
+	atomic.AddInt64(&b.errors, 1)
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.failures = 0
+		b.openUntil = time.Now().Add(b.cooldown)
+		atomic.AddInt64(&b.opened, 1)
+	}
+	return true
+}
+
+func (b *CircuitBreaker) enqueue(keys []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retries = append(b.retries, keys...)
+	atomic.AddInt64(&b.retryQueued, int64(len(keys)))
+	if over := len(b.retries) - maxRetryInvalidations; over > 0 {
+		b.retries = b.retries[over:]
+		atomic.AddInt64(&b.retryDropped, int64(over))
+	}
+}
+
+func (b *CircuitBreaker) dequeue(max int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.retries) < max {
+		max = len(b.retries)
+	}
+	keys := b.retries[:max]
+	b.retries = b.retries[max:]
+	return keys
+}
+
+/** リトライキューのキーを削除する */
+func (b *CircuitBreaker) retry(c *FirestoreCache) {
+	keys := b.dequeue(100)
+	if len(keys) == 0 {
+		return
+	}
+	if err := memcache.DeleteMulti(c, keys); b.record(err) {
+		b.enqueue(keys)
+		return
+	}
+	atomic.AddInt64(&b.retrySucceeded, int64(len(keys)))
+}
+
+/** キャッシュミスなどを除いたMemcacheの障害か */
+func isCacheFailure(err error) bool {
+	if err == nil || err == memcache.ErrCacheMiss || err == memcache.ErrNotStored {
+		return false
+	}
+	if errs, ok := err.(appengine.MultiError); ok {
+		for _, e := range errs {
+			if isCacheFailure(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
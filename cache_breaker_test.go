@@ -0,0 +1,86 @@
+package foon
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_連続して失敗すると開く(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute)
+	failure := errors.New("memcache is down")
+
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.record(failure))
+	assert.False(t, breaker.record(nil))
+	assert.True(t, breaker.record(failure))
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.record(failure))
+
+	// 開いている間はキャッシュを使わない
+	assert.False(t, breaker.allow())
+	stats := breaker.Stats()
+	assert.True(t, stats.Open)
+	assert.Equal(t, int64(3), stats.Errors)
+	assert.Equal(t, int64(1), stats.Opened)
+	assert.Equal(t, int64(1), stats.Skipped)
+
+	breaker.openUntil = time.Now().Add(-time.Second)
+	assert.True(t, breaker.allow())
+}
+
+func TestCircuitBreaker_キャッシュミスは障害として扱わない(t *testing.T) {
+	assert.False(t, isCacheFailure(nil))
+	assert.False(t, isCacheFailure(memcache.ErrCacheMiss))
+	assert.False(t, isCacheFailure(appengine.MultiError{nil, memcache.ErrCacheMiss}))
+	assert.True(t, isCacheFailure(appengine.MultiError{nil, errors.New("timeout")}))
+}
+
+func TestCircuitBreaker_リトライキューは上限を超えると古いものから捨てる(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	keys := make([]string, maxRetryInvalidations+3)
+	for i := range keys {
+		keys[i] = string(rune('a' + i%26))
+	}
+	breaker.enqueue(keys)
+
+	stats := breaker.Stats()
+	assert.Equal(t, int64(maxRetryInvalidations), stats.RetryPending)
+	assert.Equal(t, int64(maxRetryInvalidations+3), stats.RetryQueued)
+	assert.Equal(t, int64(3), stats.RetryDropped)
+
+	assert.Equal(t, keys[3:103], breaker.dequeue(100))
+	assert.Equal(t, int64(maxRetryInvalidations-100), breaker.Stats().RetryPending)
+}
+
+func TestCircuitBreaker_開いている間に書き込めなかったキーは削除を待つ(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.record(errors.New("memcache is down"))
+	cache := NewCache(nil, nil)
+	cache.SetCircuitBreaker(breaker)
+
+	assert.NoError(t, cache.setItems([]*memcache.Item{{Key: "foon/TestUser/user001", Value: []byte("value")}}))
+	assert.Equal(t, int64(1), breaker.Stats().RetryPending)
+	assert.Equal(t, []string{"foon/TestUser/user001"}, breaker.dequeue(100))
+}
+
+func TestCircuitBreaker_メタデータを読めない間の無効化は復旧後に削除する(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.record(errors.New("memcache is down"))
+	cache := NewCache(nil, nil)
+	cache.SetCircuitBreaker(breaker)
+
+	key := &Key{Collection: "TestUser", ID: "user001"}
+	metadata := LoadMetadata(cache, key)
+	assert.True(t, metadata.unknown)
+	assert.Empty(t, metadata.Item.Data)
+
+	invalidateQueries(cache, key, []entityChange{{nil, &TestUser{}, true}})
+	assert.Equal(t, []string{
+		memcacheKey(MetadataCache.CreateURIByKey(key).URI()),
+		memcacheKey(GroupDataCache.CreateCollectionURIByKey(key).URI()),
+	}, breaker.dequeue(100))
+}
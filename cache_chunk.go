@@ -0,0 +1,108 @@
+package foon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"google.golang.org/appengine/memcache"
+)
+
+/**
+ * Memcacheの1件あたりの上限(1MB)を超える値は、複数のチャンクに分けて保存する。
+ * 元のキーにはマニフェストを保存する。
+ * [magic][version][id(8)][count(4)][size(4)][sha256(32)]
+ */
+const (
+	chunkManifestMagic   byte = 0xf1
+	chunkManifestVersion byte = 1
+	chunkManifestSize         = 2 + 8 + 4 + 4 + sha256.Size
+
+	cacheChunkSize = 900 * 1024
+)
+
+func isChunkManifest(data []byte) bool {
+	return len(data) == chunkManifestSize && data[0] == chunkManifestMagic
+}
+
+func chunkKey(path string, id []byte, index int) string {
+	return fmt.Sprintf("%s/chunk/%x/%d", path, id, index)
+}
+
+/** 大きな値をマニフェストとチャンクに分割する */
+func splitChunks(items []*memcache.Item) ([]*memcache.Item, error) {
+	results := []*memcache.Item{}
+	for _, item := range items {
+		if len(item.Value) <= cacheChunkSize {
+			results = append(results, item)
+			continue
+		}
+		// 書き込み毎に別のチャンクにして、古いチャンクと混ざらないようにする
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		count := (len(item.Value) + cacheChunkSize - 1) / cacheChunkSize
+		for i := 0; i < count; i++ {
+			end := (i + 1) * cacheChunkSize
+			if end > len(item.Value) {
+				end = len(item.Value)
+			}
+			results = append(results, &memcache.Item{
+				Key:        chunkKey(item.Key, id, i),
+				Value:      item.Value[i*cacheChunkSize : end],
+				Expiration: item.Expiration,
+			})
+		}
+
+		sum := sha256.Sum256(item.Value)
+		manifest := bytes.NewBuffer([]byte{chunkManifestMagic, chunkManifestVersion})
+		manifest.Write(id)
+		binary.Write(manifest, binary.BigEndian, uint32(count))
+		binary.Write(manifest, binary.BigEndian, uint32(len(item.Value)))
+		manifest.Write(sum[:])
+		results = append(results, &memcache.Item{
+			Key:        item.Key,
+			Value:      manifest.Bytes(),
+			Expiration: item.Expiration,
+		})
+	}
+	return results, nil
+}
+
+/** マニフェストからチャンクを読み込んで元の値に戻す (1つでも欠けていればキャッシュミス) */
+func (c *FirestoreCache) readChunks(path string, manifest []byte) ([]byte, error) {
+	if manifest[1] != chunkManifestVersion {
+		return nil, NoSuchDocument
+	}
+	id := manifest[2:10]
+	count := int(binary.BigEndian.Uint32(manifest[10:14]))
+	size := int(binary.BigEndian.Uint32(manifest[14:18]))
+	sum := manifest[18:]
+
+	keys := []string{}
+	for i := 0; i < count; i++ {
+		keys = append(keys, memcacheKey(chunkKey(path, id, i)))
+	}
+	items, err := memcache.GetMulti(c, keys)
+	if err != nil {
+		return nil, NoSuchDocument
+	}
+
+	data := make([]byte, 0, size)
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			c.logger.Debug(fmt.Sprintf("chunk is missing (path: %s)", path))
+			return nil, NoSuchDocument
+		}
+		data = append(data, item.Value...)
+	}
+	actual := sha256.Sum256(data)
+	if len(data) != size || !bytes.Equal(actual[:], sum) {
+		c.logger.Warn(fmt.Sprintf("chunks are broken (path: %s)", path))
+		return nil, NoSuchDocument
+	}
+	return data, nil
+}
@@ -0,0 +1,60 @@
+package foon
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/memcache"
+	"strings"
+	"testing"
+)
+
+func TestCacheEntry_大きな値は圧縮される(t *testing.T) {
+	cache := NewCache(nil, nil)
+	src := &TestUser{UserID: "user001", UserName: strings.Repeat("kazuki", 10000)}
+
+	data, err := cache.asByte("foon/TestUser/user001", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entryFlagCompressed, data[3])
+	assert.True(t, len(data) < len(src.UserName))
+
+	dst := &TestUser{}
+	if err := cache.asValue("foon/TestUser/user001", data, dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, src.UserName, dst.UserName)
+
+	cache.SetCompressThreshold(0)
+	data, err = cache.asByte("foon/TestUser/user001", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0), data[3])
+}
+
+func TestCacheChunk_上限を超える値はチャンクに分割される(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), cacheChunkSize/4)
+	items, err := splitChunks([]*memcache.Item{
+		{Key: "small", Value: []byte("small")},
+		{Key: "large", Value: value},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// small + 3チャンク + マニフェスト
+	assert.Equal(t, 5, len(items))
+	assert.Equal(t, "small", items[0].Key)
+	manifest := items[4]
+	assert.Equal(t, "large", manifest.Key)
+	assert.True(t, isChunkManifest(manifest.Value))
+
+	joined := []byte{}
+	for _, item := range items[1:4] {
+		assert.True(t, strings.HasPrefix(item.Key, "large/chunk/"))
+		assert.True(t, len(item.Value) <= cacheChunkSize)
+		joined = append(joined, item.Value...)
+	}
+	assert.Equal(t, value, joined)
+}
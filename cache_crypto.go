@@ -0,0 +1,156 @@
+package foon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/** キャッシュの暗号化に使う鍵を提供する */
+type KeyProvider interface {
+	// 暗号化に使う現在の鍵 (鍵IDはエントリのヘッダーに保存される)
+	CurrentKey() (keyID string, key []byte, err error)
+	// 鍵IDに対応する鍵 (ローテーション前の鍵も返す)
+	Key(keyID string) ([]byte, error)
+}
+
+/** 固定の鍵を使うKeyProvider (テストや小規模な用途向け) */
+type StaticKeyProvider struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+func NewStaticKeyProvider(keyID string, key []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		current: keyID,
+		keys:    map[string][]byte{keyID: key},
+	}
+}
+
+/** 鍵を追加する (currentがtrueの場合は以降の暗号化に使う) */
+func (p *StaticKeyProvider) AddKey(keyID string, key []byte, current bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[keyID] = key
+	if current {
+		p.current = keyID
+	}
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *StaticKeyProvider) Key(keyID string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key (id: %s)", keyID)
+}
+
+var errBrokenEncryptedEntry = errors.New("encrypted cache entry is broken")
+
+/**
+ * エントリ毎のデータ鍵で本文を暗号化し、データ鍵をKeyProviderの鍵で暗号化する (AES-GCM)
+ * [keyIDLen][keyID][wrappedKeyLen][wrappedKey][nonce][ciphertext]
+ * ヘッダーは追加認証データとして改ざんを検知する。
+ */
+func encrypt(provider KeyProvider, header []byte, body []byte) ([]byte, error) {
+	keyID, key, err := provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) > 255 {
+		return nil, errors.New("key id is too long")
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := sealGCM(key, dataKey, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealGCM(dataKey, body, header)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(byte(len(keyID)))
+	buf.WriteString(keyID)
+	buf.WriteByte(byte(len(wrapped)))
+	buf.Write(wrapped)
+	buf.Write(sealed)
+	return buf.Bytes(), nil
+}
+
+func decrypt(provider KeyProvider, header []byte, data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errBrokenEncryptedEntry
+	}
+	idLen := int(data[0])
+	if len(data) < 1+idLen+1 {
+		return nil, errBrokenEncryptedEntry
+	}
+	keyID := string(data[1 : 1+idLen])
+	data = data[1+idLen:]
+	wrappedLen := int(data[0])
+	if len(data) < 1+wrappedLen {
+		return nil, errBrokenEncryptedEntry
+	}
+	wrapped := data[1 : 1+wrappedLen]
+	sealed := data[1+wrappedLen:]
+
+	key, err := provider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := openGCM(key, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(dataKey, sealed, header)
+}
+
+func sealGCM(key []byte, plain []byte, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, additional), nil
+}
+
+func openGCM(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errBrokenEncryptedEntry
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
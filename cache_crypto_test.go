@@ -0,0 +1,66 @@
+package foon
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCacheCrypto_暗号化したエントリを読み込める(t *testing.T) {
+	keys := NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef"))
+	cache := NewCache(nil, nil)
+	cache.SetKeyProvider(keys)
+
+	src := &TestUser{UserID: "user001", UserName: "secret name"}
+	data, err := cache.asByte("foon/TestUser/user001", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entryFlagEncrypted, data[3]&entryFlagEncrypted)
+	assert.NotContains(t, string(data), "secret name")
+
+	// 鍵をローテーションしても古い鍵のエントリは読める
+	keys.AddKey("key2", []byte("abcdef0123456789abcdef0123456789"), true)
+	dst := &TestUser{}
+	if err := cache.asValue("foon/TestUser/user001", data, dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "secret name", dst.UserName)
+
+	rotated, err := cache.asByte("foon/TestUser/user001", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(rotated), "key2")
+}
+
+func TestCacheCrypto_改ざんや鍵の不一致は読み込めない(t *testing.T) {
+	cache := NewCache(nil, nil)
+	cache.SetKeyProvider(NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef")))
+	data, err := cache.asByte("foon/TestUser/user001", &TestUser{UserID: "user001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0x01
+	assert.Error(t, cache.asValue("foon/TestUser/user001", tampered, &TestUser{}))
+
+	header := append([]byte{}, data...)
+	header[2] = JSONCodecID
+	assert.Error(t, cache.asValue("foon/TestUser/user001", header, &TestUser{}))
+
+	// 他のキーのエントリに差し替えられた場合
+	assert.Error(t, cache.asValue("foon/TestUser/user002", data, &TestUser{}))
+
+	other := NewCache(nil, nil)
+	other.SetKeyProvider(NewStaticKeyProvider("key1", []byte("abcdef0123456789abcdef0123456789")))
+	assert.Error(t, other.asValue("foon/TestUser/user001", data, &TestUser{}))
+
+	// 暗号化していないエントリや鍵のないキャッシュでは読み込まない
+	plain, err := NewCache(nil, nil).asByte("foon/TestUser/user001", &TestUser{UserID: "user001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, cache.asValue("foon/TestUser/user001", plain, &TestUser{}))
+	assert.Error(t, NewCache(nil, nil).asValue("foon/TestUser/user001", data, &TestUser{}))
+}
@@ -0,0 +1,128 @@
+package foon
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+/**
+ * キャッシュのエントリ形式
+ * [magic][version][codec][flags][schema][body...]
+ * schemaは保存した値の型のフィンガープリントで、読み込む型と異なる場合はキャッシュミスとして扱う。
+ */
+const (
+	cacheEntryMagic      byte = 0xf0
+	cacheEntryVersion    byte = 2
+	cacheEntryHeaderSize      = 4 + schemaFingerprintSize
+
+	// bodyがflateで圧縮されている
+	entryFlagCompressed byte = 1 << 0
+	// bodyが暗号化されている (圧縮後に暗号化する)
+	entryFlagEncrypted byte = 1 << 1
+
+	defaultCompressThreshold = 32 * 1024
+)
+
+var (
+	errInvalidCacheEntry = errors.New("invalid cache entry")
+	errSchemaMismatch    = errors.New("cache entry schema is mismatched")
+)
+
+/** pathは暗号化する場合の追加認証データに含め、他のキーのエントリに差し替えられても読み込まないようにする */
+func (c *FirestoreCache) asByte(path string, src interface{}) ([]byte, error) {
+	codec := c.codec
+	if codec == nil {
+		codec = GobCodec{}
+	}
+	body, err := codec.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	var flags byte = 0
+	if c.compressThreshold > 0 && len(body) > c.compressThreshold {
+		compressed, err := compress(body)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(body) {
+			body = compressed
+			flags |= entryFlagCompressed
+		}
+	}
+	if c.keys != nil {
+		flags |= entryFlagEncrypted
+	}
+	header := append([]byte{cacheEntryMagic, cacheEntryVersion, codec.ID(), flags}, typeFingerprint(src)...)
+	if c.keys != nil {
+		if body, err = encrypt(c.keys, entryAAD(header, path), body); err != nil {
+			return nil, err
+		}
+	}
+	return append(header, body...), nil
+}
+
+func (c *FirestoreCache) asValue(path string, data []byte, dst interface{}) error {
+	if len(data) < cacheEntryHeaderSize || data[0] != cacheEntryMagic {
+		return errInvalidCacheEntry
+	}
+	if data[1] != cacheEntryVersion {
+		return fmt.Errorf("unsupported cache entry version (%d)", data[1])
+	}
+	codec, err := lookupCodec(data[2])
+	if err != nil {
+		return err
+	}
+	if string(data[4:cacheEntryHeaderSize]) != typeFingerprint(dst) {
+		return errSchemaMismatch
+	}
+	flags := data[3]
+	body := data[cacheEntryHeaderSize:]
+	if flags&^(entryFlagCompressed|entryFlagEncrypted) != 0 {
+		return fmt.Errorf("unsupported cache entry flags (%d)", flags)
+	}
+	if c.keys != nil {
+		// 暗号化を有効にしている場合は暗号化されていないエントリを信用しない
+		if flags&entryFlagEncrypted == 0 {
+			return errors.New("cache entry is not encrypted")
+		}
+		if body, err = decrypt(c.keys, entryAAD(data[:cacheEntryHeaderSize], path), body); err != nil {
+			return err
+		}
+	} else if flags&entryFlagEncrypted != 0 {
+		return errors.New("cache entry is encrypted but key provider is not set")
+	}
+	if flags&entryFlagCompressed != 0 {
+		if body, err = decompress(body); err != nil {
+			return err
+		}
+	}
+	return codec.Unmarshal(body, dst)
+}
+
+func entryAAD(header []byte, path string) []byte {
+	return append(append([]byte{}, header...), path...)
+}
+
+func compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	writer, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
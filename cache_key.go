@@ -18,13 +18,14 @@ func (c CacheURI) URI() string {
 }
 
 func (c CacheKey) CreateURIByKey(key *Key) IURI {
+	ns := cacheNamespace()
 	if c == InstanceCache {
-		return CacheURI(fmt.Sprintf("%s/%s", c, key.Path()))
+		return CacheURI(fmt.Sprintf("%s/%s%s", c, ns, key.Path()))
 	}
-	return CacheURI(fmt.Sprintf("%s/%s", c, key.CollectionPath()))
+	return CacheURI(fmt.Sprintf("%s/%s%s", c, ns, key.CollectionPath()))
 }
 
 
 func (c CacheKey) CreateCollectionURIByKey(key *Key) IURI {
-	return CacheURI(fmt.Sprintf("%s/%s", c, key.Collection))
+	return CacheURI(fmt.Sprintf("%s/%s%s", c, cacheNamespace(), key.Collection))
 }
@@ -14,13 +14,17 @@ type IURI interface {
 
 /** クエリ結果などを保持するためのキャッシュ (関連のPut時には全削除される) */
 type CacheMetadata struct {
-	Item  *CacheMetadataItem
-	cache *FirestoreCache
+	Item       *CacheMetadataItem
+	cache      *FirestoreCache
+	collection string
+	// Memcacheの障害で読み込めず、登録されているクエリが分からない
+	unknown bool
 }
 
 type CacheMetadataItem struct {
 	MemcachePath string
 	Data         []string
+	Queries      map[string]*QueryDescriptor
 }
 
 type MetadataItem struct {
@@ -29,51 +33,142 @@ type MetadataItem struct {
 }
 
 func LoadGroupMetaData(cache *FirestoreCache, key *Key) *CacheMetadata {
-	return loadMataData(GroupDataCache.CreateCollectionURIByKey(key).URI(), cache)
+	return loadMataData(GroupDataCache.CreateCollectionURIByKey(key).URI(), key.Collection, cache)
 }
 
 func LoadMetadata(cache *FirestoreCache, key *Key) *CacheMetadata {
 	path := MetadataCache.CreateURIByKey(key).URI()
-	return loadMataData(path, cache)
+	return loadMataData(path, key.Collection, cache)
 }
 
-func loadMataData(path string, cache *FirestoreCache) *CacheMetadata {
+func loadMataData(path string, collection string, cache *FirestoreCache) *CacheMetadata {
 	res := &CacheMetadataItem{}
 
-	cache.logger.Trace(fmt.Sprintf("load metadata (key: %s)", path))
+	cache.logger.Debug(fmt.Sprintf("load metadata (key: %s)", path))
 
-	err := cache.GetCache(path, res)
+	data, err := cache.lookupItem(path)
 	if err == nil {
-		cache.logger.Trace(fmt.Sprintf("metadata cache is hit (%+v)", res.Data))
-		return &CacheMetadata{res, cache}
+		err = cache.decode(path, data, res)
+	}
+	if err == nil {
+		cache.logger.Debug(fmt.Sprintf("metadata cache is hit (%+v)", res.Data))
+		if res.Queries == nil {
+			res.Queries = map[string]*QueryDescriptor{}
+		}
+		return &CacheMetadata{res, cache, collection, false}
 	} else {
 		if NoSuchDocument.IsNot(err) {
-			cache.logger.Warning(fmt.Sprintf("failed to load metadata (reason: %+v)", err))
+			cache.logger.Warn(fmt.Sprintf("failed to load metadata (reason: %+v)", err))
 		}
 	}
 
 	res.MemcachePath = path
 	res.Data = []string{}
-	return &CacheMetadata{res, cache}
+	res.Queries = map[string]*QueryDescriptor{}
+	return &CacheMetadata{res, cache, collection, err == errCacheUnavailable}
 }
 
 func (c *CacheMetadata) Save() error {
-	return c.cache.PutCache(c.Item.MemcachePath, c.Item)
+	return c.cache.putItem(c.collection, c.Item.MemcachePath, c.Item)
 }
 
 func (c *CacheMetadata) DeleteAll() error {
-	c.cache.logger.Trace(fmt.Sprintf("delete metadata (%s)", c.Item.MemcachePath))
+	c.cache.logger.Debug(fmt.Sprintf("delete metadata (%s)", c.Item.MemcachePath))
+	if c.unknown {
+		return c.deleteUnknown()
+	}
 	if len(c.Item.Data) == 0 {
 		return nil
 	}
 	keys := []string{}
 	for _, path := range c.Item.Data {
-		c.cache.logger.Trace(fmt.Sprintf("delete metadata cache (%s)", path))
+		c.cache.logger.Debug(fmt.Sprintf("delete metadata cache (%s)", path))
 		keys = append(keys, path)
 	}
 	keys = append(keys, c.Item.MemcachePath)
 	c.Item.Data = []string{}
-	return memcache.DeleteMulti(c.cache.Context, keys)
+	c.Item.Queries = map[string]*QueryDescriptor{}
+	return c.cache.deleteItems(keys)
+}
+
+/**
+ * 読み込めなかったメタデータは削除する (Memcacheが使えない間はリトライキューに入り、復旧後に削除される)
+ * メタデータがなければ登録されていたクエリのキャッシュも使われない。
+ */
+func (c *CacheMetadata) deleteUnknown() error {
+	c.cache.logger.Debug(fmt.Sprintf("delete unknown metadata (%s)", c.Item.MemcachePath))
+	return c.cache.deleteItems([]string{c.Item.MemcachePath})
+}
+
+/** クエリの条件を登録する (次のPut時に一緒に保存される) */
+func (c *CacheMetadata) Describe(desc *QueryDescriptor) {
+	if len(desc.URIs) == 0 {
+		return
+	}
+	c.Item.Queries[desc.URIs[0]] = desc
+}
+
+/** 変更によって結果が変わり得るクエリのキャッシュのみ削除する */
+func (c *CacheMetadata) Invalidate(changes []entityChange) error {
+	if c.unknown {
+		return c.deleteUnknown()
+	}
+	if len(c.Item.Data) == 0 {
+		return nil
+	}
+	for _, change := range changes {
+		if !change.Known {
+			return c.DeleteAll()
+		}
+	}
+
+	owners := map[string]*QueryDescriptor{}
+	for _, desc := range c.Item.Queries {
+		for _, uri := range desc.URIs {
+			owners[uri] = desc
+		}
+	}
+
+	deletes := map[string]bool{}
+	for _, path := range c.Item.Data {
+		desc, ok := owners[path]
+		if !ok {
+			// 条件が登録されていないキャッシュは常に削除する
+			deletes[path] = true
+			continue
+		}
+		for _, change := range changes {
+			if desc.Affected(change) {
+				for _, uri := range desc.URIs {
+					deletes[uri] = true
+				}
+				delete(c.Item.Queries, desc.URIs[0])
+				break
+			}
+		}
+	}
+
+	if len(deletes) == 0 {
+		return nil
+	}
+
+	remains := []string{}
+	keys := []string{}
+	for _, path := range c.Item.Data {
+		if deletes[path] {
+			c.cache.logger.Debug(fmt.Sprintf("delete metadata cache (%s)", path))
+			keys = append(keys, path)
+		} else {
+			remains = append(remains, path)
+		}
+	}
+	if len(remains) == 0 {
+		return c.DeleteAll()
+	}
+
+	c.Item.Data = remains
+	c.cache.deleteItems(keys)
+	return c.Save()
 }
 
 func (c *CacheMetadata) Has(key IURI) bool {
@@ -90,9 +185,9 @@ func (c *CacheMetadata) Put(uri IURI, src interface{}) error {
 }
 
 func (c *CacheMetadata) Load(key IURI, src interface{}) error {
-	c.cache.logger.Trace("try to load Cache.")
+	c.cache.logger.Debug("try to load Cache.")
 	if !c.Has(key) {
-		c.cache.logger.Trace("cache is not registy")
+		c.cache.logger.Debug("cache is not registy")
 		return NoSuchDocument
 	}
 
@@ -106,11 +201,12 @@ func (c *CacheMetadata) PutMulti(datas []MetadataItem) error {
 		if !c.Has(data.Key) {
 			c.Item.Data = append(c.Item.Data, data.Key.URI())
 		}
-		bytes, err := c.cache.asByte(data.Data)
+		bytes, err := c.cache.asByte(data.Key.URI(), data.Data)
 		if err != nil {
-			c.cache.logger.Warning(fmt.Sprintf("failed to save cache. (reason: %v)", err))
+			c.cache.logger.Warn(fmt.Sprintf("failed to save cache. (reason: %v)", err))
 			return err
 		}
+		c.cache.metrics.encoded(c.collection, len(bytes))
 		strs = append(strs, data.Key.URI())
 		items = append(items, &memcache.Item{
 			Key:        data.Key.URI(),
@@ -118,11 +214,12 @@ func (c *CacheMetadata) PutMulti(datas []MetadataItem) error {
 			Expiration: time.Hour * 24 * 5,
 		})
 	}
-	bytes, err := c.cache.asByte(c.Item)
+	bytes, err := c.cache.asByte(c.Item.MemcachePath, c.Item)
 	if err != nil {
-		c.cache.logger.Warning(fmt.Sprintf("failed to save metadata. (reason: %v)", err))
+		c.cache.logger.Warn(fmt.Sprintf("failed to save metadata. (reason: %v)", err))
 		return err
 	}
+	c.cache.metrics.encoded(c.collection, len(bytes))
 	strs = append(strs, c.Item.MemcachePath)
 	items = append(items, &memcache.Item{
 		Key:        c.Item.MemcachePath,
@@ -130,11 +227,11 @@ func (c *CacheMetadata) PutMulti(datas []MetadataItem) error {
 		Expiration: time.Hour * 24 * 5,
 	})
 
-	c.cache.logger.Trace(fmt.Sprintf("metadata save (%+v)", strs))
+	c.cache.logger.Debug(fmt.Sprintf("metadata save (%+v)", strs))
 
-	err = memcache.SetMulti(c.cache.Context, items)
+	err = c.cache.setItems(items)
 	if err != nil {
-		c.cache.logger.Warning(fmt.Sprintf("failed to save cache (reason: %v)", err))
+		c.cache.logger.Warn(fmt.Sprintf("failed to save cache (reason: %v)", err))
 	}
 
 	return err
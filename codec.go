@@ -0,0 +1,137 @@
+package foon
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+/** キャッシュの値をバイト列に変換する */
+type Codec interface {
+	// エントリのヘッダーに書き込む識別子 (登録するCodecで一意にする)
+	ID() byte
+	Name() string
+	Marshal(src interface{}) ([]byte, error)
+	Unmarshal(data []byte, dst interface{}) error
+}
+
+const (
+	GobCodecID     byte = 1
+	JSONCodecID    byte = 2
+	MsgpackCodecID byte = 3
+)
+
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[byte]Codec{
+		GobCodecID:     GobCodec{},
+		JSONCodecID:    JSONCodec{},
+		MsgpackCodecID: MsgpackCodec{},
+	}
+)
+
+/** 独自のCodecを登録する (読み込み時はヘッダーのIDからCodecを選ぶ) */
+func RegisterCodec(codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+	codecs[codec.ID()] = codec
+}
+
+func lookupCodec(id byte) (Codec, error) {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	if codec, ok := codecs[id]; ok {
+		return codec, nil
+	}
+	return nil, fmt.Errorf("unknown codec (id: %d)", id)
+}
+
+type GobCodec struct{}
+
+func (GobCodec) ID() byte {
+	return GobCodecID
+}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(src interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(src); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, dst interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(dst)
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ID() byte {
+	return JSONCodecID
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(src interface{}) ([]byte, error) {
+	return json.Marshal(src)
+}
+
+func (JSONCodec) Unmarshal(data []byte, dst interface{}) error {
+	return json.Unmarshal(data, dst)
+}
+
+/**
+ * MessagePack形式のCodec
+ * 構造体はJSONと同じ規則(jsonタグ)で一度汎用的な値に変換してからエンコードする。
+ */
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ID() byte {
+	return MsgpackCodecID
+}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) Marshal(src interface{}) ([]byte, error) {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := writeMsgpack(buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, dst interface{}) error {
+	reader := &msgpackReader{data: data}
+	value, err := reader.read()
+	if err != nil {
+		return err
+	}
+	if reader.pos != len(data) {
+		return fmt.Errorf("msgpack: %d bytes remain", len(data)-reader.pos)
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, dst)
+}
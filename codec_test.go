@@ -0,0 +1,74 @@
+package foon
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCodec_各Codecでエンコードしたエントリを読み込める(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	src := &TestUser{
+		UserID:    "user001",
+		UserName:  "kazuki",
+		Age:       -300,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}, MsgpackCodec{}} {
+		cache := NewCache(nil, nil)
+		cache.SetCodec(codec)
+		data, err := cache.asByte("foon/TestUser/user001", src)
+		if err != nil {
+			t.Fatalf("failed to encode (codec: %s, reason: %v)", codec.Name(), err)
+		}
+		assert.Equal(t, codec.ID(), data[2])
+
+		dst := &TestUser{}
+		if err := cache.asValue("foon/TestUser/user001", data, dst); err != nil {
+			t.Fatalf("failed to decode (codec: %s, reason: %v)", codec.Name(), err)
+		}
+		assert.Equal(t, src.UserID, dst.UserID, codec.Name())
+		assert.Equal(t, src.UserName, dst.UserName, codec.Name())
+		assert.Equal(t, src.Age, dst.Age, codec.Name())
+		assert.True(t, src.CreatedAt.Equal(dst.CreatedAt), codec.Name())
+	}
+}
+
+func TestCodec_Msgpackで様々な値を扱える(t *testing.T) {
+	long := make([]int, 300)
+	for i := range long {
+		long[i] = i * 1000
+	}
+	src := map[string]interface{}{
+		"nil":    nil,
+		"bool":   true,
+		"float":  1.5,
+		"string": string(make([]byte, 70000)),
+		"list":   long,
+	}
+	data, err := MsgpackCodec{}.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := map[string]interface{}{}
+	if err := (MsgpackCodec{}).Unmarshal(data, &dst); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, dst["nil"])
+	assert.Equal(t, true, dst["bool"])
+	assert.Equal(t, 1.5, dst["float"])
+	assert.Equal(t, 70000, len(dst["string"].(string)))
+	assert.Equal(t, 300, len(dst["list"].([]interface{})))
+	assert.Equal(t, float64(299000), dst["list"].([]interface{})[299])
+}
+
+func TestCodec_不正なエントリはエラーになる(t *testing.T) {
+	cache := NewCache(nil, nil)
+	dst := &TestUser{}
+	assert.Error(t, cache.asValue("foon/TestUser/user001", []byte{}, dst))
+	assert.Error(t, cache.asValue("foon/TestUser/user001", []byte("plain gob"), dst))
+	assert.Error(t, cache.asValue("foon/TestUser/user001", []byte{cacheEntryMagic, cacheEntryVersion, 99, 0}, dst))
+	assert.Error(t, cache.asValue("foon/TestUser/user001", []byte{cacheEntryMagic, cacheEntryVersion, MsgpackCodecID, 0, 0xdb}, dst))
+}
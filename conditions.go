@@ -6,6 +6,10 @@ import (
 	"bytes"
 		"sort"
 	"crypto/md5"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 	)
 
 type Query interface {
@@ -25,6 +29,7 @@ type Conditions struct {
 	limit int
 	cursor *Cursor
 	cursorQuery CursorQuery
+	endQuery CursorQuery
 	group   string
 	Queries Queries
 }
@@ -56,9 +61,22 @@ func NewConditions() *Conditions {
 	}
 }
 
+/** 複製を返す (各メソッドは元の条件を変更せずに新しい条件を返すので、同じ条件を使い回せる) */
+func (w *Conditions) Clone() *Conditions {
+	c := *w
+	c.Queries = append(Queries{}, w.Queries...)
+	if w.cursor != nil {
+		cursor := *w.cursor
+		cursor.Orders = append([]CursorOrder{}, w.cursor.Orders...)
+		c.cursor = &cursor
+	}
+	return &c
+}
+
 func (w *Conditions) CollectionGroup(collectionId string) *Conditions {
-	w.group = collectionId
-	return w
+	c := w.Clone()
+	c.group = collectionId
+	return c
 }
 
 func (w *Conditions) CollectionGroupWithKey(key *Key) *Conditions {
@@ -66,56 +84,183 @@ func (w *Conditions) CollectionGroupWithKey(key *Key) *Conditions {
 }
 
 func (w *Conditions) Where(column string, operation string, value interface{}) *Conditions {
-	w.Queries = append(w.Queries, Where{column, operation, value})
-	return w
+	c := w.Clone()
+	c.Queries = append(c.Queries, Where{column, operation, value})
+	return c
 }
 
 func (w *Conditions) Limit(limit int) *Conditions {
-	w.limit = limit
-	w.Queries = append(w.Queries, Limit(limit))
-	return w
+	c := w.Clone()
+	c.limit = limit
+	c.Queries = append(c.Queries, Limit(limit))
+	return c
 }
 
 func (w *Conditions) Offset(offset int) *Conditions {
-	w.Queries = append(w.Queries, Offset(offset))
-	return w
+	c := w.Clone()
+	c.Queries = append(c.Queries, Offset(offset))
+	return c
 }
 
 func (w *Conditions) OrderBy(column string, direction firestore.Direction) *Conditions {
-	w.Queries = append(w.Queries, Order{column,direction})
-	if w.cursor == nil {
-		w.cursor = newCursor()
+	c := w.Clone()
+	c.Queries = append(c.Queries, Order{column,direction})
+	if c.cursor == nil {
+		c.cursor = newCursor()
 	}
-	w.cursor.AddField(column, direction)
-	return w
+	c.cursor.AddField(column, direction)
+	return c
 }
 
 func (w *Conditions) StartAfter(cursor *Cursor) *Conditions {
-	w.cursorQuery = &StartAfter{}
-	w.cursor = cursor
-	return w
+	c := w.Clone()
+	c.cursorQuery = &StartAfter{cursorBound{Cursor: cursor}}
+	c.cursor = cursor
+	return c
 }
 
-// TODO: StartAt, EndsAt, EndsAfter ...etc
+func (w *Conditions) StartAt(cursor *Cursor) *Conditions {
+	c := w.Clone()
+	c.cursorQuery = &StartAt{cursorBound{Cursor: cursor}}
+	c.cursor = cursor
+	return c
+}
 
-type StartAfter struct {
+func (w *Conditions) EndAt(cursor *Cursor) *Conditions {
+	c := w.Clone()
+	c.endQuery = &EndAt{cursorBound{Cursor: cursor}}
+	return c
 }
 
-func (w StartAfter) Queryer(query firestore.Query, cursor *Cursor, f *Foon) (firestore.Query, error) {
-	doc, err := cursor.snapshot(f)
+func (w *Conditions) EndBefore(cursor *Cursor) *Conditions {
+	c := w.Clone()
+	c.endQuery = &EndBefore{cursorBound{Cursor: cursor}}
+	return c
+}
+
+/** OrderByで指定したフィールドの値から開始する (値はOrderByと同じ順で指定する) */
+func (w *Conditions) StartAfterValues(values ...interface{}) *Conditions {
+	c := w.Clone()
+	c.cursorQuery = &StartAfter{cursorBound{Values: values}}
+	return c
+}
+
+func (w *Conditions) StartAtValues(values ...interface{}) *Conditions {
+	c := w.Clone()
+	c.cursorQuery = &StartAt{cursorBound{Values: values}}
+	return c
+}
+
+func (w *Conditions) EndAtValues(values ...interface{}) *Conditions {
+	c := w.Clone()
+	c.endQuery = &EndAt{cursorBound{Values: values}}
+	return c
+}
+
+func (w *Conditions) EndBeforeValues(values ...interface{}) *Conditions {
+	c := w.Clone()
+	c.endQuery = &EndBefore{cursorBound{Values: values}}
+	return c
+}
+
+/**
+ * クエリの開始・終了位置 (カーソルかOrderByのフィールドの値のどちらかを持つ)
+ * カーソルがnilの場合は何もしない (最初のページ)
+ */
+type cursorBound struct {
+	Cursor *Cursor
+	Values []interface{}
+	// コレクショングループのクエリか (ドキュメントIDの指定方法が異なる)
+	group bool
+	// カーソルの値を使わずにドキュメントを読み込んで位置を指定する
+	snapshot bool
+}
+
+func (b cursorBound) apply(query firestore.Query, f *Foon, fn func(query firestore.Query, docSnapshotOrFieldValues ...interface{}) firestore.Query) (firestore.Query, error) {
+	if len(b.Values) > 0 {
+		return fn(query, b.Values...), nil
+	}
+	if b.Cursor == nil {
+		return query, nil
+	}
+	if b.Cursor.positional() && !b.snapshot {
+		return fn(query, b.Cursor.cursorValues(b.group)...), nil
+	}
+	doc, err := b.Cursor.snapshot(f)
 	if err != nil {
 		return query, err
 	}
-	query = cursor.setOrders(query)
-	query = query.StartAfter(doc)
-	return query, nil
+	return fn(query, doc), nil
 }
 
-func (w StartAfter) Hash(cursor *Cursor) string {
-	if cursor == nil {
-		return "startAfter"
+func (b cursorBound) hash(name string) string {
+	if len(b.Values) > 0 {
+		values := []string{}
+		for _, value := range b.Values {
+			values = append(values, canonicalValue(value))
+		}
+		return fmt.Sprintf("%s:values:[%s]", name, strings.Join(values, ","))
+	}
+	if b.Cursor == nil {
+		return name
 	}
-	return fmt.Sprintf("startAftr:%s", cursor.planeCursor())
+	return fmt.Sprintf("%s:%s", name, b.Cursor.planeCursor())
+}
+
+/** 並び順の指定に使うカーソル (値で指定した場合はnil) */
+func (b cursorBound) documentCursor() *Cursor {
+	if len(b.Values) > 0 {
+		return nil
+	}
+	return b.Cursor
+}
+
+type StartAfter struct {
+	cursorBound
+}
+
+func (w StartAfter) Queryer(query firestore.Query, cursor *Cursor, f *Foon) (firestore.Query, error) {
+	return w.apply(query, f, firestore.Query.StartAfter)
+}
+
+func (w StartAfter) Hash(cursor *Cursor) string {
+	return w.hash("startAfter")
+}
+
+type StartAt struct {
+	cursorBound
+}
+
+func (w StartAt) Queryer(query firestore.Query, cursor *Cursor, f *Foon) (firestore.Query, error) {
+	return w.apply(query, f, firestore.Query.StartAt)
+}
+
+func (w StartAt) Hash(cursor *Cursor) string {
+	return w.hash("startAt")
+}
+
+type EndAt struct {
+	cursorBound
+}
+
+func (w EndAt) Queryer(query firestore.Query, cursor *Cursor, f *Foon) (firestore.Query, error) {
+	return w.apply(query, f, firestore.Query.EndAt)
+}
+
+func (w EndAt) Hash(cursor *Cursor) string {
+	return w.hash("endAt")
+}
+
+type EndBefore struct {
+	cursorBound
+}
+
+func (w EndBefore) Queryer(query firestore.Query, cursor *Cursor, f *Foon) (firestore.Query, error) {
+	return w.apply(query, f, firestore.Query.EndBefore)
+}
+
+func (w EndBefore) Hash(cursor *Cursor) string {
+	return w.hash("endBefore")
 }
 
 
@@ -130,7 +275,7 @@ func (w Where) Queryer(query firestore.Query) firestore.Query {
 }
 
 func (w Where) Hash() string {
-	return fmt.Sprintf("%s-%s-%v", w.Column, w.Operation, w.Value)
+	return fmt.Sprintf("%s %s %s", strconv.Quote(w.Column), strconv.Quote(w.Operation), canonicalValue(w.Value))
 }
 
 func (w Where) Order() int {
@@ -182,7 +327,7 @@ func (w Order) Queryer(query firestore.Query) firestore.Query {
 }
 
 func (w Order) Hash() string {
-	return fmt.Sprintf("orderBy:%d-%v", w.Column, w.Direction)
+	return fmt.Sprintf("orderBy:%s-%d", strconv.Quote(w.Column), w.Direction)
 }
 
 func (w Order) Order() int {
@@ -197,44 +342,126 @@ func (c Conditions) HasNoConditions() bool {
 	return len(c.Queries) == 0
 }
 
-func (c Conditions) Hash() string {
-	if len(c.Queries) == 0 {
-		return ""
+/** 条件がない (コレクション全体の取得になる) */
+func (c Conditions) isEmpty() bool {
+	return len(c.Queries) == 0 && c.group == "" && c.cursorQuery == nil && c.endQuery == nil
+}
+
+/**
+ * クエリの正規形
+ * Whereは順序によらず同じ結果になるので並べ替え、OrderByは指定順のまま、Limit・Offsetは最後の指定のみを使う (Firestoreと同じ)。
+ */
+func (c Conditions) canonical() []string {
+	filters := []string{}
+	orders := []string{}
+	others := []string{}
+	limit, offset := "", ""
+	for _, q := range c.Queries {
+		switch query := q.(type) {
+		case Where:
+			filters = append(filters, query.Hash())
+		case Order:
+			orders = append(orders, query.Hash())
+		case Limit:
+			limit = query.Hash()
+		case Offset:
+			offset = query.Hash()
+		default:
+			others = append(others, query.Hash())
+		}
 	}
-	sort.Sort(c.Queries)
+	sort.Strings(filters)
 
-	buf := bytes.Buffer{}
+	lines := []string{}
 	if c.group != "" {
-		buf.WriteString(c.group)
+		lines = append(lines, "group:"+strconv.Quote(c.group))
 	}
-
-	for _, cond := range c.Queries {
-		buf.WriteString(cond.Hash())
+	lines = append(lines, filters...)
+	lines = append(lines, orders...)
+	lines = append(lines, others...)
+	for _, line := range []string{limit, offset} {
+		if line != "" {
+			lines = append(lines, line)
+		}
 	}
-
 	if c.cursorQuery != nil {
-		buf.WriteString(c.cursorQuery.Hash(c.cursor))
+		lines = append(lines, c.cursorQuery.Hash(c.cursor))
+	}
+	if c.endQuery != nil {
+		lines = append(lines, c.endQuery.Hash(c.cursor))
 	}
+	return lines
+}
 
+func (c Conditions) Hash() string {
+	if c.isEmpty() {
+		return ""
+	}
 	hash := md5.New()
-	hash.Write(buf.Bytes())
+	for _, line := range c.canonical() {
+		hash.Write([]byte(line))
+		hash.Write([]byte{'\n'})
+	}
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
 func (c Conditions) String() string {
-	if len(c.Queries) == 0 {
+	if c.isEmpty() {
 		return ""
 	}
-	sort.Sort(c.Queries)
 	buf := bytes.Buffer{}
-	for _, cond := range c.Queries {
-		buf.WriteString(cond.Hash())
+	for _, line := range c.canonical() {
+		buf.WriteString(line)
 		buf.WriteString("\n")
 	}
 	return buf.String()
 }
 
+/** 型を区別する値の正規形 (int64(1)と"1"は別の値になり、intとint64の1は同じ値になる) */
+func canonicalValue(value interface{}) string {
+	return canonicalValueOf(reflect.ValueOf(value))
+}
+
+func canonicalValueOf(value reflect.Value) string {
+	if value.IsValid() && value.CanInterface() {
+		if ref, ok := value.Interface().(*firestore.DocumentRef); ok && ref != nil {
+			return "ref:" + strconv.Quote(ref.Path)
+		}
+	}
+	v := newFieldValueOf(value)
+	switch v.Kind {
+	case NullKind:
+		return "null"
+	case BoolKind:
+		return "bool:" + strconv.FormatBool(v.Bool)
+	case IntKind:
+		return "int:" + strconv.FormatInt(v.Int, 10)
+	case FloatKind:
+		return "float:" + strconv.FormatFloat(v.Float, 'g', -1, 64)
+	case StringKind:
+		return "string:" + strconv.Quote(v.String)
+	case TimeKind:
+		return "time:" + v.Time.UTC().Format(time.RFC3339Nano)
+	case ListKind:
+		for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+			value = value.Elem()
+		}
+		items := []string{}
+		for i := 0; i < value.Len(); i++ {
+			items = append(items, canonicalValueOf(value.Index(i)))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	}
+	if !value.CanInterface() {
+		return "unknown:" + value.Type().String()
+	}
+	return fmt.Sprintf("%T:%#v", value.Interface(), value.Interface())
+}
+
 func (c Conditions) Query(query firestore.Query, f *Foon) (firestore.Query, error) {
+	if err := c.Validate(); err != nil {
+		return query, err
+	}
 	return c.query(query, f)
 }
 
@@ -242,8 +469,26 @@ func (c Conditions) query(query firestore.Query, f *Foon) (firestore.Query, erro
 	for _ , q := range c.Queries {
 		query = q.Queryer(query)
 	}
-	if c.cursor != nil && c.cursorQuery != nil {
-		q, err := c.cursorQuery.Queryer(query, c.cursor, f)
+	// 値で指定した位置はOrderByと値の数を合わせる必要があるので、カーソルの位置はドキュメントを読み込んで指定する
+	positional := false
+	if cursor := c.documentCursor(); cursor != nil {
+		positional = cursor.positional() && !c.hasValuesBound()
+		if !c.hasOrder() {
+			// OrderByがない場合はカーソルの並び順を使う
+			query = cursor.setOrders(query)
+		} else if positional && !cursor.sameOrders(c.effectiveOrders()) {
+			// 並び順が異なると値の数が合わない
+			return query, ErrCursorMismatch
+		}
+		if positional {
+			query = cursor.tiebreak(query)
+		}
+	}
+	for _, bound := range []CursorQuery{c.cursorQuery, c.endQuery} {
+		if bound == nil {
+			continue
+		}
+		q, err := c.queryBound(bound, positional).Queryer(query, c.cursor, f)
 		if err != nil {
 			return query, err
 		}
@@ -252,11 +497,216 @@ func (c Conditions) query(query firestore.Query, f *Foon) (firestore.Query, erro
 	return query , nil
 }
 
+/** 開始・終了位置のどちらかを値で指定しているか */
+func (c Conditions) hasValuesBound() bool {
+	for _, bound := range []CursorQuery{c.cursorQuery, c.endQuery} {
+		if b, ok := bound.(interface{ documentCursor() *Cursor }); ok && b.documentCursor() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+/** クエリの種類とカーソルの指定方法を持たせた開始・終了位置を返す */
+func (c Conditions) queryBound(bound CursorQuery, positional bool) CursorQuery {
+	group := c.group != ""
+	switch b := bound.(type) {
+	case *StartAfter:
+		copied := *b
+		copied.group, copied.snapshot = group, !positional
+		return &copied
+	case *StartAt:
+		copied := *b
+		copied.group, copied.snapshot = group, !positional
+		return &copied
+	case *EndAt:
+		copied := *b
+		copied.group, copied.snapshot = group, !positional
+		return &copied
+	case *EndBefore:
+		copied := *b
+		copied.group, copied.snapshot = group, !positional
+		return &copied
+	}
+	return bound
+}
+
+/**
+ * カーソルを作ったクエリを識別するハッシュ
+ * 次のページではOrderByやLimitを省略できる(カーソルの並び順を使う)ので、絞り込みの条件のみを含める。
+ */
+func (c Conditions) fingerprint(key *Key) string {
+	hash := md5.New()
+	hash.Write([]byte(key.CollectionPath()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(c.group))
+	filters := []string{}
+	for _, q := range c.Queries {
+		if where, ok := q.(Where); ok {
+			filters = append(filters, where.Hash())
+		}
+	}
+	sort.Strings(filters)
+	for _, filter := range filters {
+		hash.Write([]byte{0})
+		hash.Write([]byte(filter))
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+/**
+ * 開始・終了位置のカーソルが別のクエリで作られていればエラーを返す (strictの場合はFingerprintのない従来のカーソルも拒否する)
+ * カーソルのドキュメントはクエリのコレクション(コレクショングループの場合は同じコレクションID)のものに限る。
+ */
+func (c Conditions) verifyCursor(key *Key, strict bool) error {
+	for _, bound := range []CursorQuery{c.cursorQuery, c.endQuery} {
+		b, ok := bound.(interface{ documentCursor() *Cursor })
+		if !ok {
+			continue
+		}
+		cursor := b.documentCursor()
+		if cursor == nil {
+			continue
+		}
+		if cursor.Path != "" && !c.inCollection(key, cursor.Path) {
+			return ErrCursorMismatch
+		}
+		if cursor.Fingerprint == "" {
+			if strict {
+				return ErrInvalidCursor
+			}
+			continue
+		}
+		if cursor.Fingerprint != c.fingerprint(key) {
+			return ErrCursorMismatch
+		}
+	}
+	return nil
+}
+
+/** ドキュメントのパスがクエリの対象のコレクションのものか */
+func (c Conditions) inCollection(key *Key, docPath string) bool {
+	segments := strings.Split(docPath, "/")
+	if len(segments)%2 != 0 {
+		return false
+	}
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	collection := strings.Join(segments[:len(segments)-1], "/")
+	if c.group != "" {
+		return segments[len(segments)-2] == c.group
+	}
+	return collection == key.CollectionPath()
+}
+
+/**
+ * ページの取得に使う条件 (Limitをlimitに置き換え、reverseの場合は並び順を逆にする)
+ * 開始・終了位置は引き継ぎ、reverseの場合は入れ替える。
+ */
+func (c Conditions) page(limit int, reverse bool) *Conditions {
+	page := NewConditions().CollectionGroup(c.group)
+	if reverse {
+		page.cursorQuery, page.endQuery = reverseBound(c.endQuery), reverseBound(c.cursorQuery)
+	} else {
+		page.cursorQuery, page.endQuery = c.cursorQuery, c.endQuery
+	}
+	for _, q := range c.Queries {
+		switch query := q.(type) {
+		case Limit:
+			continue
+		case Order:
+			direction := query.Direction
+			if reverse {
+				direction = reverseDirection(direction)
+			}
+			page = page.OrderBy(query.Column, direction)
+		default:
+			page.Queries = append(page.Queries, q)
+		}
+	}
+	if !page.hasOrder() {
+		// カーソルを使うため並び順を必ず指定する (不等号の条件があればそのフィールドの順)
+		order := CursorOrder{firestore.DocumentID, firestore.Asc}
+		if orders := c.effectiveOrders(); len(orders) > 0 {
+			order = orders[0]
+		}
+		if reverse {
+			order.Direction = reverseDirection(order.Direction)
+		}
+		page = page.OrderBy(order.FieldName, order.Direction)
+	}
+	return page.Limit(limit)
+}
+
+/** 並び順を逆にしたクエリで同じ範囲になる開始・終了位置 (開始位置は終了位置に、終了位置は開始位置になる) */
+func reverseBound(bound CursorQuery) CursorQuery {
+	switch b := bound.(type) {
+	case *StartAt:
+		return &EndAt{b.reversed()}
+	case *StartAfter:
+		return &EndBefore{b.reversed()}
+	case *EndAt:
+		return &StartAt{b.reversed()}
+	case *EndBefore:
+		return &StartAfter{b.reversed()}
+	}
+	return bound
+}
+
+func (b cursorBound) reversed() cursorBound {
+	if b.Cursor == nil {
+		return b
+	}
+	cursor := *b.Cursor
+	cursor.Orders = []CursorOrder{}
+	for _, order := range b.Cursor.Orders {
+		cursor.Orders = append(cursor.Orders, CursorOrder{order.FieldName, reverseDirection(order.Direction)})
+	}
+	b.Cursor = &cursor
+	return b
+}
+
+func reverseDirection(direction firestore.Direction) firestore.Direction {
+	if direction == firestore.Desc {
+		return firestore.Asc
+	}
+	return firestore.Desc
+}
+
+func (c Conditions) hasOrder() bool {
+	for _, q := range c.Queries {
+		if _, ok := q.(Order); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/** 開始・終了位置に指定したカーソルのうち最初のもの */
+func (c Conditions) documentCursor() *Cursor {
+	for _, bound := range []CursorQuery{c.cursorQuery, c.endQuery} {
+		if b, ok := bound.(interface{ documentCursor() *Cursor }); ok {
+			if cursor := b.documentCursor(); cursor != nil {
+				return cursor
+			}
+		}
+	}
+	return nil
+}
+
 func (c Conditions) URI(key *Key) IURI {
-	if c.HasNoConditions() {
+	if c.isEmpty() {
 		return CollectionCache.CreateURIByKey(key)
 	}
-	return ConditionURI(fmt.Sprintf("foon/%s/conds/%s", key.CollectionPath(), c.Hash()))
+	return ConditionURI(fmt.Sprintf("foon/%s%s/conds/%s", cacheNamespace(), key.CollectionPath(), c.Hash()))
+}
+
+func (c Conditions) KeysURI(key *Key) IURI {
+	uri := c.URI(key)
+	return ConditionURI(fmt.Sprintf("%s/%s", uri.URI(), "keys"))
 }
 
 func (c Conditions) CursorURI(key *Key) IURI {
@@ -0,0 +1,137 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestConditions_メソッドは元の条件を変更しない(t *testing.T) {
+	base := NewConditions().Where("num", ">", 1).OrderBy("num", firestore.Desc)
+	hash := base.Hash()
+
+	limited := base.Limit(5)
+	reordered := base.OrderBy("name", firestore.Asc)
+	grouped := base.CollectionGroup("CursorTest")
+
+	assert.Equal(t, hash, base.Hash())
+	assert.Equal(t, 2, len(base.Queries))
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}}, base.cursor.Orders)
+	assert.Equal(t, "", base.group)
+	assert.NotEqual(t, hash, limited.Hash())
+	assert.Equal(t, 5, limited.limit)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}, {"name", firestore.Asc}}, reordered.cursor.Orders)
+	assert.Equal(t, "CursorTest", grouped.group)
+
+	// Hashは並べ替えてもクエリの順序を変更しない
+	assert.Equal(t, Where{"num", ">", 1}, base.Queries[0])
+
+	clone := base.Clone()
+	clone.Queries[0] = Where{"num", ">", 2}
+	assert.Equal(t, hash, base.Hash())
+}
+
+func TestConditions_同じ条件を並行して使い回せる(t *testing.T) {
+	key := &Key{Collection: "CursorTest"}
+	base := NewConditions().Where("num", ">", 1).OrderBy("num", firestore.Desc).Where("name", "==", "a").Limit(10)
+	hash := base.Hash()
+	uri := base.URI(key).URI()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Equal(t, hash, base.Hash())
+			assert.Equal(t, uri, base.URI(key).URI())
+			derived := base.Offset(i).StartAfterValues(i)
+			assert.NotEqual(t, hash, derived.Hash())
+			assert.Equal(t, base.fingerprint(key), derived.fingerprint(key))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 4, len(base.Queries))
+	assert.Equal(t, 10, base.limit)
+}
+
+func TestConditions_同じクエリは同じHashになる(t *testing.T) {
+	equivalents := [][]*Conditions{
+		{
+			NewConditions().Where("num", ">", 1).Where("name", "==", "a"),
+			NewConditions().Where("name", "==", "a").Where("num", ">", int64(1)),
+		},
+		{
+			NewConditions().Where("abc", "==", 1).Where("abd", "==", 2),
+			NewConditions().Where("abd", "==", 2).Where("abc", "==", 1),
+		},
+		{
+			NewConditions().Limit(10).Limit(5),
+			NewConditions().Limit(5),
+		},
+		{
+			NewConditions().Where("num", "in", []int{1, 2}),
+			NewConditions().Where("num", "in", []interface{}{int64(1), int32(2)}),
+		},
+	}
+	for _, conds := range equivalents {
+		assert.Equal(t, conds[0].Hash(), conds[1].Hash(), conds[0].String())
+	}
+}
+
+func TestConditions_違うクエリは違うHashになる(t *testing.T) {
+	key := &Key{Collection: "CursorTest"}
+	conds := []*Conditions{
+		NewConditions().Where("num", "==", 1),
+		NewConditions().Where("num", "==", "1"),
+		NewConditions().Where("num", "==", 1.5),
+		NewConditions().Where("num", "==", true),
+		NewConditions().Where("num", "==", nil),
+		NewConditions().Where("num", "==", []string{"1"}),
+		NewConditions().Where("num", "==", 1).Limit(5),
+		NewConditions().Where("num", "==", 1).Offset(5),
+		NewConditions().Where("num", "==", 1).CollectionGroup("CursorTest"),
+		NewConditions().Where("nu", "==", "m-1"),
+		NewConditions().OrderBy("num", firestore.Asc).OrderBy("name", firestore.Asc),
+		NewConditions().OrderBy("name", firestore.Asc).OrderBy("num", firestore.Asc),
+		NewConditions().OrderBy("num", firestore.Desc).OrderBy("name", firestore.Asc),
+		NewConditions().OrderBy("num", firestore.Asc).StartAfterValues(1),
+		NewConditions().OrderBy("num", firestore.Asc).StartAfterValues("1"),
+		NewConditions().CollectionGroup("CursorTest"),
+	}
+	unique := map[string]bool{}
+	for _, c := range conds {
+		unique[c.URI(key).URI()] = true
+	}
+	assert.Equal(t, len(conds), len(unique))
+	assert.Equal(t, CollectionCache.CreateURIByKey(key).URI(), NewConditions().URI(key).URI())
+}
+
+func TestConditions_同じ条件で2回クエリを実行しても結果とキャッシュのキーが変わらない(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	server.addUser("user001", "foo", 20)
+	server.addUser("user002", "bar", 30)
+	server.addUser("user003", "baz", 40)
+	s := newFakeStore(t, server)
+
+	key := &Key{Collection: "TestUser"}
+	conditions := NewConditions().Where("age", ">", 10).Where("userName", "==", "foo").OrderBy("age", firestore.Asc).Limit(2)
+	uri, keysURI, hash := conditions.URI(key).URI(), conditions.KeysURI(key).URI(), conditions.Hash()
+
+	first := []TestUser{}
+	assert.NoError(t, s.getChildrenWithoutCache(key, &first, conditions))
+	second := []TestUser{}
+	assert.NoError(t, s.getChildrenWithoutCache(key, &second, conditions))
+
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, second)
+	assert.Equal(t, uri, conditions.URI(key).URI())
+	assert.Equal(t, keysURI, conditions.KeysURI(key).URI())
+	assert.Equal(t, hash, conditions.Hash())
+
+	// Firestoreへのクエリも同じ
+	assert.Len(t, server.requests, 2)
+	assert.True(t, proto.Equal(server.requests[0], server.requests[1]))
+	assert.Equal(t, int32(2), server.requests[1].GetStructuredQuery().GetLimit().GetValue())
+}
@@ -0,0 +1,86 @@
+package foon
+
+import (
+	"reflect"
+	"strings"
+)
+
+/**
+ * Firestoreの課金対象の操作数
+ * IndexEntriesは書き込んだフィールドから見積もった単一フィールドインデックスのエントリ数
+ * (昇順・降順で1フィールド2件、配列は要素毎に1件。複合インデックスや除外設定は考慮しない)
+ */
+type Cost struct {
+	Reads        int64
+	Writes       int64
+	Deletes      int64
+	IndexEntries int64
+}
+
+/** リクエストで許可する操作数 (0の場合は制限しない) */
+type Budget struct {
+	Reads   int64
+	Writes  int64
+	Deletes int64
+}
+
+func (b Budget) exceeded(cost Cost) bool {
+	return (b.Reads > 0 && cost.Reads > b.Reads) ||
+		(b.Writes > 0 && cost.Writes > b.Writes) ||
+		(b.Deletes > 0 && cost.Deletes > b.Deletes)
+}
+
+/** このFoon(リクエスト)で発生したFirestoreの課金対象の操作数 */
+func (s *Foon) Cost() Cost {
+	return s.Summary().Cost
+}
+
+/** 操作数の上限を設定する (超えた後の操作はErrBudgetExceededを返す) */
+func (s *Foon) SetBudget(budget Budget) {
+	s.budget = budget
+}
+
+func (s *Foon) checkBudget() error {
+	if s.budget.exceeded(s.Cost()) {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+/** 結果が0件のクエリも1件の読み込みとして課金される */
+func (c *FirestoreCache) countEmptyQuery() {
+	c.summary.update(func(summary *RequestSummary) {
+		summary.Cost.Reads++
+	})
+}
+
+func (c *FirestoreCache) countIndexEntries(src interface{}) {
+	entries := estimateIndexEntries(src)
+	c.summary.update(func(summary *RequestSummary) {
+		summary.Cost.IndexEntries += entries
+	})
+}
+
+func estimateIndexEntries(src interface{}) int64 {
+	value := reflect.Indirect(reflect.ValueOf(src))
+	if value.Kind() != reflect.Struct {
+		return 0
+	}
+	var entries int64 = 0
+	types := value.Type()
+	for i := 0; i < types.NumField(); i++ {
+		field := types.Field(i)
+		if field.PkgPath != "" || strings.Split(field.Tag.Get("firestore"), ",")[0] == "-" {
+			continue
+		}
+		switch value.Field(i).Kind() {
+		case reflect.Slice, reflect.Array:
+			entries += int64(value.Field(i).Len())
+		case reflect.Map:
+			entries += int64(value.Field(i).Len()) * 2
+		default:
+			entries += 2
+		}
+	}
+	return entries
+}
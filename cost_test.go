@@ -0,0 +1,64 @@
+package foon
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type costEntity struct {
+	ID     string            `firestore:"-" foon:"id"`
+	Name   string            `firestore:"name"`
+	Tags   []string          `firestore:"tags"`
+	Labels map[string]string `firestore:"labels"`
+	secret string
+}
+
+func TestCost_インデックスのエントリ数を見積もる(t *testing.T) {
+	entity := &costEntity{
+		ID:     "1",
+		Name:   "foo",
+		Tags:   []string{"a", "b", "c"},
+		Labels: map[string]string{"k": "v"},
+	}
+	// name(2) + tags(3) + labels(2)
+	assert.Equal(t, int64(7), estimateIndexEntries(entity))
+	assert.Equal(t, int64(0), estimateIndexEntries("not struct"))
+}
+
+func TestFoon_予算を超えた後の操作はエラーになる(t *testing.T) {
+	s := &Foon{Context: context.Background(), cache: newCache(nil, nil), logger: legacyLogger{}}
+	s.cache.SetMetrics(nil)
+	s.SetBudget(Budget{Reads: 2})
+
+	read := func() error {
+		return s.intercept(&Operation{Kind: QueryOperation, Keys: []*Key{{Collection: "users"}}}, func(s *Foon) error {
+			s.cache.countFirestore("users", 2, 0, 0)
+			return nil
+		})
+	}
+	assert.Nil(t, read())
+	// 上限ちょうどまでは実行できる
+	assert.Nil(t, read())
+	assert.True(t, ErrBudgetExceeded.Is(read()))
+
+	s.cache.countEmptyQuery()
+	cost := s.Cost()
+	assert.Equal(t, int64(5), cost.Reads)
+	assert.Equal(t, int64(0), cost.Writes)
+}
+
+func TestFoon_クエリの読み込み中に予算を超えると中断する(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	for i := 0; i < 5; i++ {
+		server.addUser(fmt.Sprintf("user%03d", i), "name", int64(i))
+	}
+	s := newFakeStore(t, server)
+	s.SetBudget(Budget{Reads: 2})
+
+	docs, err := s.queryDocuments(&Key{Collection: "TestUser"}, NewConditions())
+	assert.True(t, ErrBudgetExceeded.Is(err))
+	assert.Nil(t, docs)
+	assert.Equal(t, int64(3), s.Cost().Reads)
+}
@@ -3,12 +3,14 @@ package foon
 import (
 	"crypto/aes"
 		"encoding/base64"
+	"encoding/json"
 	"cloud.google.com/go/firestore"
 	"fmt"
 	"strings"
 	"errors"
 	"strconv"
 	"io"
+	"path"
 	"crypto/rand"
 	cipher "crypto/cipher"
 )
@@ -18,6 +20,21 @@ type Cursor struct {
 	ID string
 	Path string
 	Orders []CursorOrder
+	// 最後のドキュメントのOrdersのフィールドの値 (ない場合はドキュメントを読み込んで位置を決める)
+	Values []FieldValue
+	// カーソルを作ったクエリ (親のKey・コレクショングループ・条件) のハッシュ
+	Fingerprint string
+}
+
+/** Values・Fingerprintを持つカーソルの文字列の接頭辞 */
+const cursorValuesPrefix = "v2:"
+
+type cursorPayload struct {
+	ID          string
+	Path        string
+	Orders      []CursorOrder
+	Values      []FieldValue
+	Fingerprint string
 }
 
 type CursorOrder struct {
@@ -29,7 +46,7 @@ var cursorKey = []byte("2f8472d791c48224ec9753505d60e205")
 
 
 func newCursor() *Cursor {
-	return &Cursor{"", "", []CursorOrder{}}
+	return &Cursor{"", "", []CursorOrder{}, nil, ""}
 }
 
 func (c Cursor) snapshot(f *Foon) (*firestore.DocumentSnapshot, error) {
@@ -50,7 +67,97 @@ func (c Cursor) String() string {
 	return c.StringWithSeed(cursorKey)
 }
 
+/** OrdersのフィールドとドキュメントIDで位置を指定できるか */
+func (c Cursor) hasValues() bool {
+	return len(c.Values) > 0 && len(c.Values) == len(c.Orders) && c.Path != ""
+}
+
+/** 値とドキュメントIDで位置を指定できるか (Ordersがない場合はドキュメントIDのみで指定する) */
+func (c Cursor) positional() bool {
+	return c.Path != "" && len(c.Values) == len(c.Orders)
+}
+
+/** 並び順がordersと同じか */
+func (c Cursor) sameOrders(orders []CursorOrder) bool {
+	if len(c.Orders) != len(orders) {
+		return false
+	}
+	for i, order := range c.Orders {
+		if order != orders[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * StartAfterなどに渡す値 (最後にドキュメントIDを付与する)
+ * クライアントはクエリのパスにドキュメントIDを繋げて参照にするので、
+ * コレクションのクエリではID、コレクショングループのクエリ(データベースのパス)ではdocuments以下のパスを渡す。
+ */
+func (c Cursor) cursorValues(group bool) []interface{} {
+	values := []interface{}{}
+	for _, value := range c.Values {
+		values = append(values, value.value())
+	}
+	if group {
+		return append(values, "documents/"+c.Path)
+	}
+	return append(values, path.Base(c.Path))
+}
+
+/** 同じ値のドキュメントの順序を固定するためのドキュメントIDの並び順 (Firestoreの暗黙の並び順と同じにする) */
+func (c Cursor) tiebreak(query firestore.Query) firestore.Query {
+	direction := firestore.Asc
+	for _, order := range c.Orders {
+		if order.FieldName == firestore.DocumentID {
+			return query
+		}
+		direction = order.Direction
+	}
+	return query.OrderBy(firestore.DocumentID, direction)
+}
+
+/** 最後のドキュメントから並び順のフィールドの値を取得する (取得できない場合は値を持たないカーソルになる) */
+func (c *Cursor) setValues(doc *firestore.DocumentSnapshot) {
+	c.setValuesWith(func(field string) (FieldValue, bool) {
+		data, err := doc.DataAt(field)
+		if err != nil {
+			return FieldValue{}, false
+		}
+		return newFieldValue(data), true
+	})
+}
+
+/** エンティティから並び順のフィールドの値を取得する */
+func (c *Cursor) setEntityValues(entity interface{}) {
+	c.setValuesWith(func(field string) (FieldValue, bool) {
+		return lookupFieldValue(entity, field)
+	})
+}
+
+func (c *Cursor) setValuesWith(lookup func(field string) (FieldValue, bool)) {
+	c.Values = nil
+	values := []FieldValue{}
+	for _, order := range c.Orders {
+		if order.FieldName == firestore.DocumentID {
+			return
+		}
+		value, ok := lookup(order.FieldName)
+		if !ok || value.Kind == UnknownKind || value.Kind == ListKind {
+			return
+		}
+		values = append(values, value)
+	}
+	c.Values = values
+}
+
 func (c Cursor) planeCursor() string {
+	if c.hasValues() || c.Fingerprint != "" {
+		if data, err := json.Marshal(cursorPayload{c.ID, c.Path, c.Orders, c.Values, c.Fingerprint}); err == nil {
+			return cursorValuesPrefix + base64.RawURLEncoding.EncodeToString(data)
+		}
+	}
 	slises := []string{c.ID,c.Path}
 	for _, order := range c.Orders {
 		slises = append(slises, fmt.Sprintf("%s.%d", order.FieldName, order.Direction))
@@ -67,6 +174,7 @@ func (c Cursor) NewCursorWithOrders() *Cursor {
 		ID: "",
 		Path: "",
 		Orders: c.Orders,
+		Values: nil,
 	}
 }
 
@@ -88,10 +196,15 @@ func (c Cursor) StringWithSeed(seed []byte) string {
 	return base64.URLEncoding.EncodeToString(cipherText)
 }
 
+/**
+ * 組み込みの鍵で復元する
+ * Deprecated: 改ざんを検知できないので、Foon.SetCursorCodecかFoon.SetKeyProviderで鍵を設定してFoon.ParseCursorを使う。
+ */
 func NewCursor(cursor string) (*Cursor, error) {
 	return NewCursorWithSeed(cursor, cursorKey)
 }
 
+/** Deprecated: 改ざんを検知できないので、CursorCodecを使う。 */
 func NewCursorWithSeed(cursor string, seed []byte) (*Cursor, error) {
 	if cursor == "" {
 		return nil, nil
@@ -102,8 +215,8 @@ func NewCursorWithSeed(cursor string, seed []byte) (*Cursor, error) {
 	}
 
 	cipherText , err := base64.URLEncoding.DecodeString(cursor)
-	if err != nil {
-		return nil, err
+	if err != nil || len(cipherText) < aes.BlockSize {
+		return nil, ErrInvalidCursor
 	}
 
 	decryptedText := make([]byte, len(cipherText[aes.BlockSize:]))
@@ -114,7 +227,21 @@ func NewCursorWithSeed(cursor string, seed []byte) (*Cursor, error) {
 }
 
 func decodeCursor(decodeString string) (*Cursor , error){
+	if strings.HasPrefix(decodeString, cursorValuesPrefix) {
+		data, err := base64.RawURLEncoding.DecodeString(decodeString[len(cursorValuesPrefix):])
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		payload := cursorPayload{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return &Cursor{payload.ID, payload.Path, payload.Orders, payload.Values, payload.Fingerprint}, nil
+	}
 	slises := strings.Split(decodeString, ":")
+	if len(slises) < 2 {
+		return nil, ErrInvalidCursor
+	}
 	id := slises[0]
 	path := slises[1]
 	orders := []CursorOrder{}
@@ -122,16 +249,16 @@ func decodeCursor(decodeString string) (*Cursor , error){
 		for i := 2; i < len(slises); i++ {
 			strs := strings.Split(slises[i], ".")
 			if len(strs) != 2 {
-				return nil, errors.New("cursor is invalid")
+				return nil, ErrInvalidCursor
 			}
 			order, err := strconv.ParseInt(strs[1], 10,64)
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse order (reason:%v)", err)
+				return nil, ErrInvalidCursor
 			}
 			orders = append(orders, CursorOrder{strs[0], firestore.Direction(order)})
 		}
 	}
-	return &Cursor{id, path, orders}, nil
+	return &Cursor{id, path, orders, nil, ""}, nil
 }
 
 
@@ -0,0 +1,106 @@
+package foon
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+const cursorTokenVersion byte = 1
+
+/** キャッシュの暗号化と同じ鍵を使わないよう、KeyProviderの鍵からカーソル用の鍵を導出する */
+var cursorKeyLabel = []byte("foon/cursor")
+
+/**
+ * カーソルをアプリケーションの鍵で暗号化する (AES-GCM)
+ * 鍵IDをトークンに含めるので、ローテーション前の鍵で作ったカーソルも復元できる。
+ * 暗号化にはKeyProviderの鍵そのものではなく、カーソル用に導出した鍵を使う。
+ */
+type CursorCodec struct {
+	keys KeyProvider
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+func NewCursorCodec(keys KeyProvider) *CursorCodec {
+	return &CursorCodec{keys: keys, now: time.Now}
+}
+
+/** カーソルの有効期限を設定する (0以下の場合は期限なし) */
+func (c *CursorCodec) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+/**
+ * [version][keyIDLen][keyID][expiresAt(unix秒, 0は期限なし)][nonce][ciphertext]
+ * 暗号文以外のヘッダーは追加認証データとして改ざんを検知する。
+ */
+func (c *CursorCodec) Encode(cursor *Cursor) (string, error) {
+	keyID, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	if len(keyID) > 255 {
+		return "", ErrInvalidCursor
+	}
+	var expiresAt int64
+	if c.ttl > 0 {
+		expiresAt = c.now().Add(c.ttl).Unix()
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(cursorTokenVersion)
+	buf.WriteByte(byte(len(keyID)))
+	buf.WriteString(keyID)
+	binary.Write(buf, binary.BigEndian, expiresAt)
+	header := buf.Bytes()
+
+	sealed, err := sealGCM(deriveCursorKey(key), []byte(cursor.planeCursor()), header)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(header, sealed...)), nil
+}
+
+func (c *CursorCodec) Decode(token string) (*Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if len(data) < 2 || data[0] != cursorTokenVersion {
+		return nil, ErrInvalidCursor
+	}
+	idLen := int(data[1])
+	headerLen := 2 + idLen + 8
+	if len(data) < headerLen {
+		return nil, ErrInvalidCursor
+	}
+	header := data[:headerLen]
+	keyID := string(data[2 : 2+idLen])
+	expiresAt := int64(binary.BigEndian.Uint64(data[2+idLen : headerLen]))
+
+	key, err := c.keys.Key(keyID)
+	if err != nil || key == nil {
+		return nil, ErrUnknownCursorKey
+	}
+	plain, err := openGCM(deriveCursorKey(key), data[headerLen:], header)
+	if err != nil {
+		return nil, ErrCursorTampered
+	}
+	if expiresAt > 0 && c.now().Unix() > expiresAt {
+		return nil, ErrCursorExpired
+	}
+	return decodeCursor(string(plain))
+}
+
+func deriveCursorKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(cursorKeyLabel)
+	return mac.Sum(nil)
+}
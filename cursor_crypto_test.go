@@ -0,0 +1,105 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestCursor() *Cursor {
+	cursor := newCursor()
+	cursor.AddField("num", firestore.Desc)
+	cursor.ID = "cursor001"
+	cursor.Path = "CursorTest/cursor001"
+	return cursor
+}
+
+func TestCursorCodec_暗号化したカーソルを復元できる(t *testing.T) {
+	keys := NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef"))
+	codec := NewCursorCodec(keys)
+	token, err := codec.Encode(newTestCursor())
+	assert.NoError(t, err)
+
+	// 鍵をローテーションしても以前のカーソルを復元できる
+	keys.AddKey("key2", []byte("abcdef0123456789abcdef0123456789"), true)
+	decoded, err := codec.Decode(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "CursorTest/cursor001", decoded.Path)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}}, decoded.Orders)
+
+	// 削除された鍵のカーソルは復元できない
+	other := NewCursorCodec(NewStaticKeyProvider("key2", []byte("abcdef0123456789abcdef0123456789")))
+	_, err = other.Decode(token)
+	assert.Equal(t, ErrUnknownCursorKey, err)
+}
+
+func TestCursorCodec_改ざんや不正な形式を検知する(t *testing.T) {
+	codec := NewCursorCodec(NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef")))
+	token, err := codec.Encode(newTestCursor())
+	assert.NoError(t, err)
+
+	data, _ := base64.RawURLEncoding.DecodeString(token)
+	data[len(data)-1] ^= 0x01
+	_, err = codec.Decode(base64.RawURLEncoding.EncodeToString(data))
+	assert.Equal(t, ErrCursorTampered, err)
+
+	for _, invalid := range []string{"!!!", "AQ", base64.RawURLEncoding.EncodeToString([]byte{2, 0})} {
+		_, err = codec.Decode(invalid)
+		assert.Equal(t, ErrInvalidCursor, err, invalid)
+	}
+
+	// 従来の形式でも不正な文字列でpanicしない
+	_, err = NewCursor("YWJj")
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = decodeCursor("nocolon")
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestCursorCodec_有効期限が切れたカーソルは使えない(t *testing.T) {
+	codec := NewCursorCodec(NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef")))
+	codec.SetTTL(time.Minute)
+	now := time.Now()
+	codec.now = func() time.Time { return now }
+	token, err := codec.Encode(newTestCursor())
+	assert.NoError(t, err)
+
+	_, err = codec.Decode(token)
+	assert.NoError(t, err)
+
+	codec.now = func() time.Time { return now.Add(2 * time.Minute) }
+	_, err = codec.Decode(token)
+	assert.Equal(t, ErrCursorExpired, err)
+}
+
+func TestCursorCodec_キャッシュの鍵とは別の鍵で暗号化する(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	codec := NewCursorCodec(NewStaticKeyProvider("key1", key))
+	token, err := codec.Encode(newTestCursor())
+	assert.NoError(t, err)
+
+	// KeyProviderの鍵そのものでは復号できない
+	data, _ := base64.RawURLEncoding.DecodeString(token)
+	headerLen := 2 + len("key1") + 8
+	_, err = openGCM(key, data[headerLen:], data[:headerLen])
+	assert.Error(t, err)
+	_, err = openGCM(deriveCursorKey(key), data[headerLen:], data[:headerLen])
+	assert.NoError(t, err)
+}
+
+func TestCursorCodec_KeyProviderを設定するとCursorCodecを使う(t *testing.T) {
+	keys := NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef"))
+	s := &Foon{cache: newCache(context.Background(), legacyLogger{}), logger: legacyLogger{}}
+	s.SetKeyProvider(keys)
+
+	token := s.encodeCursor(newTestCursor())
+	decoded, err := NewCursorCodec(keys).Decode(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "CursorTest/cursor001", decoded.Path)
+
+	// 従来の形式のカーソルは受け付けない
+	_, err = s.ParseCursor(newTestCursor().String())
+	assert.Error(t, err)
+}
@@ -186,3 +186,208 @@ func TestCursor_カーソルが正常に働く(t *testing.T) {
 	cursor = store.LastCursor()
 	assert.Equal(t, "", cursor)
 }
+
+func TestConditions_開始終了位置と値でHashが変わる(t *testing.T) {
+	cursor := &Cursor{ID: "cursor001", Path: "CursorTest/cursor001", Orders: []CursorOrder{{"num", firestore.Asc}}}
+	hashes := []string{
+		NewConditions().OrderBy("num", firestore.Asc).Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).StartAtValues(10).Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).StartAfterValues(10).Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).StartAtValues("10").Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).EndAtValues(10).Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).EndBeforeValues(10).Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).StartAtValues(10).EndAtValues(20).Hash(),
+		NewConditions().OrderBy("num", firestore.Asc).StartAtValues(10).EndAtValues(30).Hash(),
+		NewConditions().Limit(5).StartAt(cursor).Hash(),
+		NewConditions().Limit(5).StartAfter(cursor).Hash(),
+		NewConditions().Limit(5).EndAt(cursor).Hash(),
+		NewConditions().Limit(5).EndBefore(cursor).Hash(),
+	}
+	unique := map[string]bool{}
+	for _, hash := range hashes {
+		unique[hash] = true
+	}
+	assert.Equal(t, len(hashes), len(unique))
+}
+
+func TestCursor_値で範囲を指定して取得できる(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8915")
+	store, err := NewStoreWithProjectID(ctx, "everychart-dev")
+
+	datas := []*CursorTest{}
+	for i := 0; i < 10; i++ {
+		datas = append(datas, &CursorTest{
+			ID:   fmt.Sprintf("range%03d", i),
+			Name: fmt.Sprintf("name%d", i),
+			Num:  i,
+		})
+	}
+	if err := store.PutMulti(&datas); err != nil {
+		t.Errorf("failed to put data (reason: %v)", err)
+	}
+
+	results := []*CursorTest{}
+	cond := NewConditions().Where("name", ">=", "name").OrderBy("num", firestore.Asc).StartAtValues(3).EndBeforeValues(6)
+	if err := store.GetByQuery(NewKey(&CursorTest{}), &results, cond); err != nil {
+		t.Errorf("failed to get data (reason: %v)", err)
+	}
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, 3, results[0].Num)
+	assert.Equal(t, 5, results[2].Num)
+
+	results = []*CursorTest{}
+	cond = NewConditions().Where("name", ">=", "name").OrderBy("num", firestore.Asc).StartAfterValues(3).EndAtValues(6)
+	if err := store.GetByQuery(NewKey(&CursorTest{}), &results, cond); err != nil {
+		t.Errorf("failed to get data (reason: %v)", err)
+	}
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, 4, results[0].Num)
+	assert.Equal(t, 6, results[2].Num)
+}
+
+func TestCursor_値を持つカーソルを復元できる(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0).UTC()
+	cursor := newCursor()
+	cursor.AddField("num", firestore.Desc)
+	cursor.AddField("time", firestore.Asc)
+	cursor.ID = "cursor001"
+	cursor.Path = "CursorTest/cursor001"
+	cursor.Values = []FieldValue{newFieldValue(int64(49)), newFieldValue(now)}
+
+	decoded, err := NewCursor(cursor.String())
+	assert.NoError(t, err)
+	assert.Equal(t, cursor.ID, decoded.ID)
+	assert.Equal(t, cursor.Path, decoded.Path)
+	assert.Equal(t, cursor.Orders, decoded.Orders)
+	assert.True(t, decoded.hasValues())
+	assert.Equal(t, int64(49), decoded.Values[0].value())
+	assert.True(t, now.Equal(decoded.Values[1].value().(time.Time)))
+
+	// 値を持たないカーソルは従来の形式のまま
+	cursor.Values = nil
+	legacy, err := NewCursor(cursor.String())
+	assert.NoError(t, err)
+	assert.Equal(t, cursor.Path, legacy.Path)
+	assert.Equal(t, cursor.Orders, legacy.Orders)
+	assert.False(t, legacy.hasValues())
+}
+
+func TestConditions_別のクエリで作られたカーソルは使えない(t *testing.T) {
+	key := &Key{Collection: "CursorTest"}
+	conditions := NewConditions().Where("num", ">", 10).OrderBy("num", firestore.Desc).Limit(5)
+	cursor := newTestCursor()
+	cursor.Fingerprint = conditions.fingerprint(key)
+
+	decoded, err := NewCursor(cursor.String())
+	assert.NoError(t, err)
+	assert.Equal(t, cursor.Fingerprint, decoded.Fingerprint)
+
+	// 同じクエリの次のページ (並び順はカーソルのものを使うので省略できる)
+	next := NewConditions().Where("num", ">", 10).OrderBy("num", firestore.Desc).Limit(5).StartAfter(decoded)
+	assert.NoError(t, next.verifyCursor(key, false))
+	assert.NoError(t, NewConditions().Where("num", ">", 10).StartAfter(decoded).Limit(5).verifyCursor(key, false))
+
+	// 条件やコレクションが違う
+	other := NewConditions().Where("num", ">", 20).OrderBy("num", firestore.Desc).Limit(5).StartAfter(decoded)
+	assert.Equal(t, ErrCursorMismatch, other.verifyCursor(key, false))
+	assert.Equal(t, ErrCursorMismatch, next.verifyCursor(&Key{Collection: "OtherTest"}, false))
+
+	// Fingerprintのない従来のカーソルは鍵を設定していない場合のみ許可する
+	cursor.Fingerprint = ""
+	legacy := NewConditions().Where("num", ">", 20).StartAfter(cursor)
+	assert.NoError(t, legacy.verifyCursor(key, false))
+	assert.Equal(t, ErrInvalidCursor, legacy.verifyCursor(key, true))
+}
+
+func TestConditions_鍵を設定している場合はFingerprintのないカーソルを拒否する(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	server.addUser("user001", "foo", 20)
+	s := newFakeStore(t, server)
+	s.SetKeyProvider(NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef")))
+
+	// 従来の形式で作ったカーソル
+	forged := newCursor()
+	forged.ID = "user000"
+	forged.Path = "TestUser/user000"
+	_, err := s.ParseCursor(forged.String())
+	assert.Error(t, err)
+
+	users := []TestUser{}
+	err = s.GetByQueryWithoutCache(&Key{Collection: "TestUser"}, &users, NewConditions().StartAfter(forged))
+	assert.Equal(t, ErrInvalidCursor, err)
+	err = s.GetByQuery(&Key{Collection: "TestUser"}, &users, NewConditions().StartAfter(forged))
+	assert.Equal(t, ErrInvalidCursor, err)
+	assert.Empty(t, server.requests)
+}
+
+func TestConditions_並び順のないカーソルはドキュメントIDで位置を指定する(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	s := newFakeStore(t, server)
+	cursor := &Cursor{ID: "user001", Path: "TestUser/user001"}
+
+	if _, err := s.queryDocuments(&Key{Collection: "TestUser"}, NewConditions().StartAfter(cursor).Limit(5)); err != nil {
+		t.Fatal(err)
+	}
+	query := server.requests[0].GetStructuredQuery()
+	assert.Len(t, query.OrderBy, 1)
+	assert.Equal(t, firestore.DocumentID, query.OrderBy[0].Field.FieldPath)
+	assert.Len(t, query.StartAt.Values, 1)
+	assert.Equal(t, "projects/fake-project/databases/(default)/documents/TestUser/user001", query.StartAt.Values[0].GetReferenceValue())
+	assert.False(t, query.StartAt.Before)
+
+	// コレクショングループの場合も同じ参照になる
+	if _, err := s.queryDocuments(&Key{Collection: "TestUser"}, NewConditions().CollectionGroup("TestUser").StartAfter(cursor).Limit(5)); err != nil {
+		t.Fatal(err)
+	}
+	query = server.requests[1].GetStructuredQuery()
+	assert.Equal(t, "projects/fake-project/databases/(default)/documents/TestUser/user001", query.StartAt.Values[0].GetReferenceValue())
+}
+
+func TestConditions_並び順が異なるカーソルはエラーになる(t *testing.T) {
+	s := newFakeStore(t, &fakeFirestoreServer{})
+	key := &Key{Collection: "TestUser"}
+	cursor := &Cursor{ID: "user001", Path: "TestUser/user001", Orders: []CursorOrder{{"userName", firestore.Asc}}, Values: []FieldValue{newFieldValue("name")}}
+
+	_, err := s.queryDocuments(key, NewConditions().OrderBy("age", firestore.Desc).StartAfter(cursor))
+	assert.Equal(t, ErrCursorMismatch, err)
+
+	cursor.Orders = []CursorOrder{{"age", firestore.Desc}}
+	cursor.Values = []FieldValue{newFieldValue(int64(3))}
+	_, err = s.queryDocuments(key, NewConditions().OrderBy("age", firestore.Desc).StartAfter(cursor))
+	assert.NoError(t, err)
+}
+
+func TestConditions_別のコレクションのドキュメントを指すカーソルは使えない(t *testing.T) {
+	key := &Key{Collection: "CursorTest"}
+	conditions := NewConditions().Where("num", ">", 10).OrderBy("num", firestore.Desc)
+	cursor := newTestCursor()
+	cursor.Fingerprint = conditions.fingerprint(key)
+	assert.NoError(t, conditions.StartAfter(cursor).verifyCursor(key, false))
+
+	// Fingerprintが一致していてもパスが別のコレクションであれば拒否する
+	for _, path := range []string{"Secret/doc001", "CursorTest/cursor001/Secret/doc001", "Parent/p1/CursorTest/cursor001", "CursorTest/../Secret/doc001", "CursorTest"} {
+		forged := *cursor
+		forged.Path = path
+		assert.Equal(t, ErrCursorMismatch, conditions.StartAfter(&forged).verifyCursor(key, false), path)
+		assert.Equal(t, ErrCursorMismatch, conditions.EndBefore(&forged).verifyCursor(key, false), path)
+	}
+
+	// サブコレクションのKey
+	child := &Key{ParentPath: "Parent/p1", Collection: "CursorTest"}
+	nested := *cursor
+	nested.Path = "Parent/p1/CursorTest/cursor001"
+	nested.Fingerprint = conditions.fingerprint(child)
+	assert.NoError(t, conditions.StartAfter(&nested).verifyCursor(child, false))
+
+	// コレクショングループは同じコレクションIDであれば親は問わない
+	group := conditions.CollectionGroup("CursorTest")
+	nested.Fingerprint = group.fingerprint(key)
+	assert.NoError(t, group.StartAfter(&nested).verifyCursor(key, false))
+	nested.Path = "Parent/p1/Secret/doc001"
+	assert.Equal(t, ErrCursorMismatch, group.StartAfter(&nested).verifyCursor(key, false))
+}
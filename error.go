@@ -1,21 +1,43 @@
 package foon
 
+import "errors"
+
 type FoonError string
 
 const (
 	NoSuchDocument FoonError = "NoSuchEntity"
 	InvalidId      FoonError = "InvalidID"
+	// SetBudgetで設定した操作数を超えた
+	ErrBudgetExceeded FoonError = "BudgetExceeded"
+	// カーソルの形式が正しくない
+	ErrInvalidCursor FoonError = "InvalidCursor"
+	// カーソルが改ざんされている (または別の鍵で暗号化されている)
+	ErrCursorTampered FoonError = "CursorTampered"
+	// カーソルの有効期限が切れている
+	ErrCursorExpired FoonError = "CursorExpired"
+	// カーソルの鍵IDに対応する鍵がない
+	ErrUnknownCursorKey FoonError = "UnknownCursorKey"
+	// カーソルが別のクエリで作られている
+	ErrCursorMismatch FoonError = "CursorMismatch"
+	// 演算子と値の組み合わせが正しくない
+	ErrInvalidQuery FoonError = "InvalidQuery"
+	// Paginatorの件数が1未満
+	ErrInvalidPageSize FoonError = "InvalidPageSize"
 )
 
 func (f FoonError) Error() string {
 	return string(f)
 }
 
+/** ラップされたエラー (fmt.Errorfの%w) も辿って比較する */
 func (f FoonError) Is(err error) bool {
-	if err == nil {
-		return false
+	for err != nil {
+		if err.Error() == f.Error() {
+			return true
+		}
+		err = errors.Unwrap(err)
 	}
-	return err.Error() == f.Error()
+	return false
 }
 
 func (f FoonError) IsNot(err error) bool {
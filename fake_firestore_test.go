@@ -0,0 +1,113 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeProjectID = "fake-project"
+
+/** RunQueryとBatchGetDocumentsのみ実装したFirestoreのサーバー (クエリは条件に関係なくdocsを返す) */
+type fakeFirestoreServer struct {
+	pb.FirestoreServer
+	mu       sync.Mutex
+	docs     []*pb.Document
+	requests []*pb.RunQueryRequest
+	gets     []*pb.BatchGetDocumentsRequest
+}
+
+func (f *fakeFirestoreServer) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	docs := f.docs
+	f.mu.Unlock()
+	for _, doc := range docs {
+		if err := stream.Send(&pb.RunQueryResponse{Document: doc, ReadTime: ptypes.TimestampNow()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeFirestoreServer) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	f.mu.Lock()
+	f.gets = append(f.gets, req)
+	docs := map[string]*pb.Document{}
+	for _, doc := range f.docs {
+		docs[doc.Name] = doc
+	}
+	f.mu.Unlock()
+	for _, name := range req.Documents {
+		res := &pb.BatchGetDocumentsResponse{ReadTime: ptypes.TimestampNow()}
+		if doc, ok := docs[name]; ok {
+			res.Result = &pb.BatchGetDocumentsResponse_Found{Found: doc}
+		} else {
+			res.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeFirestoreServer) addUser(id string, name string, age int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := ptypes.TimestampNow()
+	f.docs = append(f.docs, &pb.Document{
+		Name: fmt.Sprintf("projects/%s/databases/(default)/documents/TestUser/%s", fakeProjectID, id),
+		Fields: map[string]*pb.Value{
+			"userName": {ValueType: &pb.Value_StringValue{StringValue: name}},
+			"age":      {ValueType: &pb.Value_IntegerValue{IntegerValue: age}},
+		},
+		CreateTime: now,
+		UpdateTime: now,
+	})
+}
+
+/** fakeFirestoreServerに接続するFoon (MemcacheはAppEngineのContextがないので使われない) */
+func newFakeStore(t *testing.T, server *fakeFirestoreServer) *Foon {
+	os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	pb.RegisterFirestoreServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	ctx := context.Background()
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := firestore.NewClient(ctx, fakeProjectID, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	cache := newCache(ctx, legacyLogger{})
+	cache.SetMetrics(nil)
+	cache.SetCircuitBreaker(NewCircuitBreaker(0, 0))
+	return &Foon{
+		projectId: fakeProjectID,
+		Context:   ctx,
+		client:    &FirestoreClientImpl{ctx, client},
+		cache:     cache,
+		cursor:    &lastCursor{},
+		logger:    legacyLogger{},
+	}
+}
@@ -111,18 +111,22 @@ func (f fields) HasUniqueID() bool {
 	return f.id != nil && f.id.ID != ""
 }
 
-func (f *fields) SetID(newID string) {
-	if f.id != nil {
-		f.id.SetID(newID)
-	}
+func (f *fields) SetID(newID string) error {
 	if f.self != nil {
 		f.self.ID = newID
 	}
+	if f.id != nil {
+		return f.id.SetID(newID)
+	}
+	return nil
 }
 
-func (f *fields) UpdateField(newID string, updateTime time.Time) {
-	f.SetID(newID)
+func (f *fields) UpdateField(newID string, updateTime time.Time) error {
+	if err := f.SetID(newID); err != nil {
+		return err
+	}
 	f.UpdateTime(updateTime)
+	return nil
 }
 
 func newCollectionField(t reflect.Type) collectionField {
@@ -236,7 +240,11 @@ func findField(value reflect.Value, tagName string, tagValue string) (*reflect.V
 
 func (i *idField) SetID(id string) error {
 	i.ID = id
-	if i.field != nil && i.field.CanSet() {
+	// IDのフィールドがない構造体はKeyのみで扱う
+	if i.field == nil {
+		return nil
+	}
+	if i.field.CanSet() {
 		i.field.SetString(id)
 		return nil
 	}
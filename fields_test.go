@@ -127,3 +127,29 @@ func TestDateField_Embeddedも正常に変更されるかどうか(t *testing.T)
 	assert.Equal(t, test.UpdatedAt , now2, "updatedAt(data) is not synced.")
 
 }
+
+type testUnexportedID struct {
+	__kind string `foon:"collection,KindTest"`
+	id     string `foon:"id"`
+}
+
+func TestKey_IDを設定できない場合はエラーを返す(t *testing.T) {
+	key := &Key{Collection: "KindTest", ID: "test"}
+	assert.NoError(t, key.Inject(&testNormal{}))
+	assert.Error(t, key.Inject(&testUnexportedID{}))
+}
+
+type testNoID struct {
+	__kind string `foon:"collection,KindTest"`
+	Name   string
+}
+
+func TestKey_IDのフィールドがない場合は何もしない(t *testing.T) {
+	key := &Key{Collection: "KindTest", ID: "test"}
+	assert.NoError(t, key.Inject(&testNoID{}))
+
+	info, err := newFields(&testNoID{})
+	assert.NoError(t, err)
+	assert.NoError(t, info.UpdateField("test", time.Now()))
+	assert.Equal(t, "test", newKey(info).ID)
+}
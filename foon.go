@@ -9,17 +9,56 @@ import (
 	"google.golang.org/api/iterator"
 	"google.golang.org/appengine"
 	"reflect"
+	"sync"
 	"time"
 )
 
 type Foon struct {
 	projectId string
 	context.Context
-	cache       *FirestoreCache
-	client      FirestoreClient
-	cursor      *Cursor
-	transaction bool
-	logger      Logger
+	cache          *FirestoreCache
+	client         FirestoreClient
+	cursor         *lastCursor
+	transaction    bool
+	logger         StructuredLogger
+	queryCacheMode QueryCacheMode
+	populate       CachePopulatePolicy
+	uow            *unitOfWork
+	verifyCache    bool
+	interceptors   []Interceptor
+	slowThresholds map[OperationKind]time.Duration
+	budget         Budget
+	cursorCodec    *CursorCodec
+	// 実行中の操作 (Interceptorに結果を返すために使う)
+	current *Operation
+}
+
+/** クエリ結果のキャッシュ方式 */
+type QueryCacheMode int
+
+const (
+	// クエリ結果(エンティティのスライス)をそのままキャッシュする
+	QueryCacheEntities QueryCacheMode = iota
+	// クエリ結果のKeyのみをキャッシュし、エンティティはInstanceCacheから解決する
+	QueryCacheKeys
+)
+
+/** クエリ結果の各ドキュメントをInstanceCacheへ書き込むかどうか */
+type CachePopulatePolicy int
+
+const (
+	// 書き込む (PopulateAlwaysと同じ)
+	PopulateDefault CachePopulatePolicy = iota
+	// 書き込まない
+	PopulateNever
+	// 常に書き込む
+	PopulateAlways
+)
+
+/** 最後に実行したクエリのカーソル (操作はFoonのコピーで実行するため、コピーの間で共有する) */
+type lastCursor struct {
+	mu     sync.Mutex
+	cursor *Cursor
 }
 
 type KeyAndData struct {
@@ -46,7 +85,7 @@ func NewStoreWithProjectID(ctx context.Context, projectID string) (*Foon, error)
 		return nil, err
 	}
 
-	logger := &defaultLogger{ctx}
+	logger := newDefaultLogger(ctx)
 	client, err := app.Firestore(ctx)
 
 	if err != nil {
@@ -57,10 +96,10 @@ func NewStoreWithProjectID(ctx context.Context, projectID string) (*Foon, error)
 		projectId:   projectID,
 		Context:     ctx,
 		client:      &FirestoreClientImpl{ctx, client},
-		cache:       &FirestoreCache{ctx, logger},
+		cache:       newCache(ctx, logger),
 		transaction: false,
-		cursor:      nil,
-		logger:      &defaultLogger{ctx},
+		cursor:      &lastCursor{},
+		logger:      logger,
 	}, nil
 }
 
@@ -69,10 +108,17 @@ func newStoreWithTransaction(foon *Foon, context context.Context, transaction *f
 		projectId:   foon.projectId,
 		Context:     context,
 		client:      &FirestoreTransactionClient{transaction, foon.client.Client()},
-		cache:       foon.cache,
-		cursor:      nil,
-		transaction: true,
-		logger:      foon.logger,
+		cache:          foon.cache,
+		cursor:         &lastCursor{},
+		transaction:    true,
+		logger:         foon.logger,
+		queryCacheMode: foon.queryCacheMode,
+		populate:       foon.populate,
+		verifyCache:    foon.verifyCache,
+		interceptors:   foon.interceptors,
+		slowThresholds: foon.slowThresholds,
+		budget:         foon.budget,
+		cursorCodec:    foon.cursorCodec,
 	}
 }
 
@@ -81,21 +127,103 @@ func NotFound(err error) bool {
 }
 
 func (s *Foon) SetLogger(logger Logger) {
+	s.SetStructuredLogger(legacyLogger{logger})
+}
+
+func (s *Foon) SetStructuredLogger(logger StructuredLogger) {
 	s.logger = logger
 	s.cache.logger = logger
 }
 
+/**
+ * 設定しているLoggerでDebugのログ(キャッシュのヒット/ミスなど)を出力するか切り替える (既定のLoggerは環境変数FOON_TRACEでも有効になる)
+ * Loggerのレベルは変更しない。
+ */
+func (s *Foon) SetTrace(enabled bool) {
+	if logger, ok := s.logger.(traceableLogger); ok {
+		logger.setTrace(enabled)
+		return
+	}
+	s.SetStructuredLogger(&traceLogger{s.logger, enabled})
+}
+
+func (s *Foon) SetCodec(codec Codec) {
+	s.cache.SetCodec(codec)
+}
+
+func (s *Foon) SetKeyProvider(keys KeyProvider) {
+	s.cache.SetKeyProvider(keys)
+}
+
+/** LastCursorとParseCursorで使う暗号化の設定 (nilの場合はSetKeyProviderの鍵から作る) */
+func (s *Foon) SetCursorCodec(codec *CursorCodec) {
+	s.cursorCodec = codec
+}
+
+func (s *Foon) SetLocalCache(local *LocalCache) {
+	s.cache.SetLocalCache(local)
+}
+
+/** Memcacheの障害時に使うサーキットブレーカーを設定する (既定ではDefaultCircuitBreakerを共有する) */
+func (s *Foon) SetCircuitBreaker(breaker *CircuitBreaker) {
+	s.cache.SetCircuitBreaker(breaker)
+}
+
+/** キャッシュの障害に関する統計 */
+func (s *Foon) CacheHealth() CacheHealthStats {
+	return s.cache.breaker.Stats()
+}
+
+/** 統計の記録先を設定する (既定ではDefaultMetricsを共有する。nilの場合は記録しない) */
+func (s *Foon) SetMetrics(metrics *Metrics) {
+	s.cache.SetMetrics(metrics)
+}
+
+func (s *Foon) Stats() Stats {
+	return Stats{
+		Collections: s.cache.metrics.Snapshot(),
+		Health:      s.cache.breaker.Stats(),
+	}
+}
+
+/** キャッシュから取得した値をFirestoreの値と比較し、差分があれば警告する (デバッグ用) */
+func (s *Foon) SetCacheVerification(enabled bool) {
+	s.verifyCache = enabled
+}
+
+func (s *Foon) SetQueryCacheMode(mode QueryCacheMode) {
+	s.queryCacheMode = mode
+}
+
+func (s *Foon) SetCachePopulatePolicy(policy CachePopulatePolicy) {
+	s.populate = policy
+}
+
+func (s *Foon) shouldPopulate() bool {
+	return s.populate != PopulateNever
+}
+
 func (s *Foon) Put(src interface{}) error {
 	info, err := newFields(src)
 	if err != nil {
 		return err
 	}
 
-	if info.HasUniqueID() {
-		return s.put(info, src)
-	}
+	op := &Operation{Kind: PutOperation, Keys: []*Key{newKey(info)}}
+	return s.intercept(op, func(s *Foon) error {
+		defer func() {
+			op.Keys = []*Key{newKey(info)}
+		}()
+		if s.uow != nil {
+			return s.uow.put(s, info, src, false)
+		}
 
-	return s.insert(info, src)
+		if info.HasUniqueID() {
+			return s.put(info, src)
+		}
+
+		return s.insert(info, src)
+	})
 }
 
 func (s *Foon) Insert(src interface{}) error {
@@ -103,7 +231,16 @@ func (s *Foon) Insert(src interface{}) error {
 	if err != nil {
 		return err
 	}
-	return s.insert(info, src)
+	op := &Operation{Kind: InsertOperation, Keys: []*Key{newKey(info)}}
+	return s.intercept(op, func(s *Foon) error {
+		defer func() {
+			op.Keys = []*Key{newKey(info)}
+		}()
+		if s.uow != nil {
+			return s.uow.put(s, info, src, true)
+		}
+		return s.insert(info, src)
+	})
 }
 
 func (s *Foon) InsertMulti(slices interface{}) error {
@@ -113,18 +250,30 @@ func (s *Foon) InsertMulti(slices interface{}) error {
 		return errors.New("src must be slice pointer.")
 	}
 
-	batch, err := s.Batch()
-	if err != nil {
-		return err
-	}
+	op := &Operation{Kind: InsertOperation, Keys: sliceKeys(value)}
+	return s.intercept(op, func(s *Foon) error {
+		if s.uow != nil {
+			defer func() {
+				op.Keys = sliceKeys(value)
+			}()
+			return s.putTracked(value, true)
+		}
+		batch, err := s.newBatch()
+		if err != nil {
+			return err
+		}
 
-	length := value.Len()
-	for i := 0; i < length; i++ {
-		res := value.Index(i).Interface()
-		batch.Create(res)
-	}
+		length := value.Len()
+		for i := 0; i < length; i++ {
+			res := value.Index(i).Interface()
+			batch.Create(res)
+		}
 
-	return batch.Commit()
+		defer func() {
+			op.Keys = sliceKeys(value)
+		}()
+		return batch.Commit()
+	})
 }
 
 func (s *Foon) PutMulti(slices interface{}) error {
@@ -134,22 +283,52 @@ func (s *Foon) PutMulti(slices interface{}) error {
 		return errors.New("src must be slice pointer.")
 	}
 
-	batch, err := s.Batch()
-	if err != nil {
-		return err
-	}
+	op := &Operation{Kind: PutOperation, Keys: sliceKeys(value)}
+	return s.intercept(op, func(s *Foon) error {
+		if s.uow != nil {
+			defer func() {
+				op.Keys = sliceKeys(value)
+			}()
+			return s.putTracked(value, false)
+		}
+		batch, err := s.newBatch()
+		if err != nil {
+			return err
+		}
 
-	keys := map[string]*Key{}
+		keys := map[string]*Key{}
 
-	length := value.Len()
-	for i := 0; i < length; i++ {
-		res := value.Index(i).Interface()
-		batch.Set(res)
-		key := NewKey(res)
-		keys[key.Path()] = key
-	}
+		length := value.Len()
+		for i := 0; i < length; i++ {
+			res := value.Index(i).Interface()
+			batch.Set(res)
+			key := NewKey(res)
+			keys[key.Path()] = key
+		}
 
-	return batch.Commit()
+		defer func() {
+			op.Keys = sliceKeys(value)
+		}()
+		return batch.Commit()
+	})
+}
+
+/** スライスの各要素をUnit of Workに記録する */
+func (s *Foon) putTracked(value reflect.Value, create bool) error {
+	for i := 0; i < value.Len(); i++ {
+		elem := value.Index(i)
+		if elem.Kind() != reflect.Ptr {
+			elem = elem.Addr()
+		}
+		info, err := newFields(elem.Interface())
+		if err != nil {
+			return err
+		}
+		if err := s.uow.put(s, info, elem.Interface(), create); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Foon) insert(info *fields, src interface{}) error {
@@ -162,17 +341,20 @@ func (s *Foon) insert(info *fields, src interface{}) error {
 		} else {
 			ref = col.NewDoc()
 		}
-		info.UpdateField(ref.ID, time.Now())
+		if err := info.UpdateField(ref.ID, time.Now()); err != nil {
+			return err
+		}
 
-		s.logger.Trace(fmt.Sprintf("insert data (Path: %s, ID: %s)", ref.Path, ref.ID))
+		s.logger.Debug("insert data", F("path", ref.Path))
 
 		_, err := ref.Create(s, src)
 		if err != nil {
 			return err
 		}
+		s.cache.countFirestore(key.Collection, 0, 1, 0)
+		s.cache.countIndexEntries(src)
 
-		LoadMetadata(s.cache, key).DeleteAll()
-		LoadGroupMetaData(s.cache, key).DeleteAll()
+		invalidateQueries(s.cache, key, []entityChange{{nil, src, true}})
 		return nil
 	}
 	if err := s.execute(command); err != nil {
@@ -187,13 +369,17 @@ func (s *Foon) put(info *fields, src interface{}) error {
 	err := s.execute(func(client FirestoreClient) error {
 		key := newKey(info)
 		ref := key.CreateDocumentRef(client.Client())
-		s.logger.Trace(fmt.Sprintf("update data (Path: %s, ID: %s)", ref.Path, ref.ID))
+		s.logger.Debug("update data", F("path", ref.Path))
+		old, known := loadCachedEntity(s.cache, key, src)
 		info.UpdateTime(time.Now())
 
 		_, err := ref.Set(s, src)
+		if err == nil {
+			s.cache.countFirestore(key.Collection, 0, 1, 0)
+			s.cache.countIndexEntries(src)
+		}
 
-		LoadMetadata(s.cache, key).DeleteAll()
-		LoadGroupMetaData(s.cache, key).DeleteAll()
+		invalidateQueries(s.cache, key, []entityChange{{old, src, known}})
 
 		return err
 	})
@@ -214,12 +400,28 @@ func (s *Foon) Get(src interface{}) error {
 		return errors.New("Get method must be spesified ID")
 	}
 
+	return s.intercept(&Operation{Kind: GetOperation, Keys: []*Key{newKey(info)}, dst: src}, func(s *Foon) error {
+		if s.uow != nil {
+			return s.uow.get(newKey(info), src, func() error {
+				return s.get(info, src)
+			})
+		}
+
+		return s.get(info, src)
+	})
+}
+
+func (s *Foon) get(info *fields, src interface{}) error {
 	if s.transaction {
 		return s.getWithoutCache(info, src)
 	}
 
-	if err := s.cache.Get(newKey(info), src); err == nil {
+	err := s.cache.Get(newKey(info), src)
+	s.cache.countInstanceCache(info.CollectionName(), err == nil)
+	if err == nil {
 		s.tracef("Get from Memcached.")
+		s.servedFromCache()
+		s.verifyCached(newKey(info), src)
 		return nil
 	} else if !NoSuchDocument.Is(err) {
 		s.warningf("failed to get Memcache %+v", err)
@@ -229,11 +431,26 @@ func (s *Foon) Get(src interface{}) error {
 }
 
 func (s *Foon) GetByKey(key *Key, src interface{}) error {
+	return s.intercept(&Operation{Kind: GetOperation, Keys: []*Key{key}, dst: src}, func(s *Foon) error {
+		if s.uow != nil {
+			return s.uow.get(key, src, func() error {
+				return s.getByKey(key, src)
+			})
+		}
+		return s.getByKey(key, src)
+	})
+}
+
+func (s *Foon) getByKey(key *Key, src interface{}) error {
 	if s.transaction {
 		return s.getByKeyWithoutCache(key, src)
 	}
 
-	if err := s.cache.Get(key, src); err == nil {
+	err := s.cache.Get(key, src)
+	s.cache.countInstanceCache(key.Collection, err == nil)
+	if err == nil {
+		s.servedFromCache()
+		s.verifyCached(key, src)
 		return nil
 	} else if !NoSuchDocument.Is(err) {
 		s.warningf("failed to get Memcache %+v", err)
@@ -243,25 +460,27 @@ func (s *Foon) GetByKey(key *Key, src interface{}) error {
 
 func (s *Foon) getByKeyWithoutCache(key *Key, src interface{}) error {
 	info, err := newFields(src)
-	key.Inject(info)
-
 	if err != nil {
-		s.logger.Warning("failed to create fields")
+		s.logger.Warn("failed to create fields")
+		return err
+	}
+	if err := key.Inject(info); err != nil {
 		return err
 	}
 	err = s.execute(func(client FirestoreClient) error {
 		docRef := key.CreateDocumentRef(client.Client())
-		s.logger.Trace(fmt.Sprintf("try to get firestore (path: %s)", docRef.Path))
+		s.logger.Debug("try to get firestore", F("path", docRef.Path))
 		doc, err := docRef.Get(s)
+		s.cache.countFirestore(key.Collection, 1, 0, 0)
 		if err != nil {
 			if doc != nil && doc.Exists() == false {
-				s.logger.Trace("not found")
+				s.logger.Debug("not found")
 				return NoSuchDocument
 			}
-			s.logger.Warning(fmt.Sprintf("failed to get document (reason:%v)", err))
+			s.logger.Warn("failed to get document", F("path", docRef.Path), F("reason", err))
 			return err
 		}
-		s.logger.Trace(fmt.Sprintf("get firestore (path: %s, exists: %v)", docRef.Path, doc.Exists()))
+		s.logger.Debug("get firestore", F("path", docRef.Path), F("exists", doc.Exists()))
 		info.updateKey(docRef)
 
 		return doc.DataTo(src)
@@ -281,8 +500,64 @@ func (s *Foon) GetMulti(src interface{}) error {
 		return err
 	}
 
+	op := &Operation{Kind: GetOperation, Keys: sliceKeys(reflect.Indirect(reflect.ValueOf(src))), dst: src}
+	return s.intercept(op, func(s *Foon) error {
+		if s.uow == nil {
+			return s.getMulti(src)
+		}
+		if err := s.getMultiTracked(src); err != nil {
+			return err
+		}
+		s.trackSlice(src)
+		return nil
+	})
+}
+
+/** 追跡しているエンティティはその値を使い、追跡していないものだけ読み込む (削除予定のものがあればNoSuchDocument) */
+func (s *Foon) getMultiTracked(src interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(src))
+	remains := reflect.MakeSlice(value.Type(), 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		elem := value.Index(i)
+		ptr := elem
+		if elem.Kind() != reflect.Ptr {
+			ptr = elem.Addr()
+		}
+		key, err := KeyError(ptr.Interface())
+		if err != nil {
+			return err
+		}
+		if !key.HasUniqueID() {
+			return errors.New("ID is required.")
+		}
+		if s.uow.isDeleted(key.Path()) {
+			return NoSuchDocument
+		}
+		if s.uow.copyTracked(key.Path(), ptr.Interface()) {
+			continue
+		}
+		remains = reflect.Append(remains, elem)
+	}
+	if remains.Len() == 0 {
+		s.servedFromCache()
+		return nil
+	}
+	loads := reflect.New(value.Type())
+	loads.Elem().Set(remains)
+	return s.getMulti(loads.Interface())
+}
+
+/** 取得したスライスの要素を追跡する (ポインタのスライスでなければ追跡できない) */
+func (s *Foon) trackSlice(src interface{}) {
+	if !s.uow.trackSlice(src) {
+		s.logger.Warn("unit of work tracks only slices of pointers", F("type", reflect.TypeOf(src).String()))
+	}
+}
+
+func (s *Foon) getMulti(src interface{}) error {
+
 	if s.transaction {
-		return s.GetMultiWithoutCache(src)
+		return s.getMultiWithoutCache(src)
 	}
 
 	caches := map[string]*CacheResult{}
@@ -314,13 +589,14 @@ func (s *Foon) GetMulti(src interface{}) error {
 	allHit := true
 
 	for _, cache := range caches {
+		s.cache.countInstanceCache(cache.Key.Collection, cache.HasCache)
 		if !cache.HasCache {
 			allHit = false
-			break
 		}
 	}
 
 	if allHit {
+		s.servedFromCache()
 		return nil
 	}
 
@@ -339,10 +615,13 @@ func (s *Foon) GetMulti(src interface{}) error {
 	if err != nil {
 		return err
 	}
+	for _, cache := range nonCaches {
+		s.cache.countFirestore(cache.Key.Collection, 1, 0, 0)
+	}
 
 	if len(values) != len(refs) {
 		// すべて取得できてたら同じになるはず
-		s.logger.Warning("invalid data")
+		s.logger.Warn("invalid data")
 		return NoSuchDocument
 	}
 
@@ -366,11 +645,19 @@ func (s *Foon) GetMultiWithoutCache(src interface{}) error {
 	if err := s.validSlice(src); err != nil {
 		return err
 	}
+	op := &Operation{Kind: GetOperation, Keys: sliceKeys(reflect.Indirect(reflect.ValueOf(src))), dst: src}
+	return s.intercept(op, func(s *Foon) error {
+		return s.getMultiWithoutCache(src)
+	})
+}
+
+func (s *Foon) getMultiWithoutCache(src interface{}) error {
 	client := s.client
 	original := reflect.Indirect(reflect.ValueOf(src))
 
 	num := original.Len()
 	refs := []*firestore.DocumentRef{}
+	collections := []string{}
 
 	for i := 0; i < num; i++ {
 		s := original.Index(i).Interface()
@@ -379,6 +666,10 @@ func (s *Foon) GetMultiWithoutCache(src interface{}) error {
 			return errors.New("ID is required.")
 		}
 		refs = append(refs, key.CreateDocumentRef(client.Client()))
+		collections = append(collections, key.Collection)
+	}
+	for _, collection := range collections {
+		s.cache.countFirestore(collection, 1, 0, 0)
 	}
 
 	values, err := client.GetAll(refs)
@@ -405,7 +696,7 @@ func (s *Foon) GetMultiWithoutCache(src interface{}) error {
 
 	if original.Len() != slices.Len() {
 		// すべて取得できてたら同じになるはず
-		s.logger.Warning("invalid data")
+		s.logger.Warn("invalid data")
 		return NoSuchDocument
 	}
 
@@ -420,7 +711,12 @@ func (s *Foon) GetByQueryWithoutCache(key *Key, src interface{}, conditions *Con
 		return err
 	}
 
-	return s.getChildrenWithoutCache(key, src, conditions)
+	return s.intercept(&Operation{Kind: QueryOperation, Keys: []*Key{key}, Conditions: conditions, dst: src}, func(s *Foon) error {
+		if err := conditions.verifyCursor(key, s.codec() != nil); err != nil {
+			return err
+		}
+		return s.getChildrenWithoutCache(key, src, conditions)
+	})
 }
 
 func (s *Foon) GetGroupByQuery(src interface{}, conditions *Conditions) error {
@@ -441,8 +737,7 @@ func (s *Foon) GetGroupByQuery(src interface{}, conditions *Conditions) error {
 	if conditions == nil {
 		conditions = NewConditions()
 	}
-	conditions.CollectionGroupWithKey(key)
-	return s.GetByQuery(key, src, conditions)
+	return s.GetByQuery(key, src, conditions.CollectionGroupWithKey(key))
 }
 
 func (s *Foon) GetByQuery(key *Key, src interface{}, conditions *Conditions) error {
@@ -450,6 +745,22 @@ func (s *Foon) GetByQuery(key *Key, src interface{}, conditions *Conditions) err
 		return err
 	}
 
+	return s.intercept(&Operation{Kind: QueryOperation, Keys: []*Key{key}, Conditions: conditions, dst: src}, func(s *Foon) error {
+		if err := s.getByQuery(key, src, conditions); err != nil {
+			return err
+		}
+		if s.uow != nil {
+			s.trackSlice(src)
+		}
+		return nil
+	})
+}
+
+func (s *Foon) getByQuery(key *Key, src interface{}, conditions *Conditions) error {
+	if err := conditions.verifyCursor(key, s.codec() != nil); err != nil {
+		return err
+	}
+
 	if s.transaction {
 		return s.getChildrenWithoutCache(key, src, conditions)
 	}
@@ -462,99 +773,302 @@ func (s *Foon) GetByQuery(key *Key, src interface{}, conditions *Conditions) err
 		metadata = LoadMetadata(s.cache, key)
 	}
 
-	if err := metadata.Load(conditions.URI(key), src); err == nil {
-		s.logger.Trace("cache is hit! " + key.Path())
-		cursor := newCursor()
-		if err := metadata.Load(conditions.CursorURI(key), cursor); err == nil {
-			s.cursor = cursor
+	if s.queryCacheMode == QueryCacheKeys {
+		keys := []*Key{}
+		if err := metadata.Load(conditions.KeysURI(key), &keys); err == nil {
+			if err := s.resolveKeys(keys, src); err == nil {
+				s.cache.countQueryCache(key.Collection, true)
+				s.servedFromCache()
+				s.logger.Debug("keys cache is hit! " + key.Path())
+				s.loadCursor(metadata, key, conditions)
+				return nil
+			} else if NoSuchDocument.IsNot(err) {
+				return err
+			}
+			s.logger.Debug("cached keys are stale. " + key.Path())
 		}
+		s.cache.countQueryCache(key.Collection, false)
+		return s.getChildrenWithoutCache(key, src, conditions)
+	}
+
+	if err := metadata.Load(conditions.URI(key), src); err == nil {
+		s.cache.countQueryCache(key.Collection, true)
+		s.servedFromCache()
+		s.logger.Debug("cache is hit! " + key.Path())
+		s.loadCursor(metadata, key, conditions)
 		return nil
 	}
+	s.cache.countQueryCache(key.Collection, false)
 
 	return s.getChildrenWithoutCache(key, src, conditions)
 }
 
-func (s *Foon) getChildrenWithoutCache(parentKey *Key, slices interface{}, conditions *Conditions) error {
+func (s *Foon) loadCursor(metadata *CacheMetadata, key *Key, conditions *Conditions) {
+	cursor := newCursor()
+	if err := metadata.Load(conditions.CursorURI(key), cursor); err == nil {
+		s.setCursor(cursor)
+	}
+}
+
+/** キャッシュされたKeyの一覧からエンティティを解決する (見つからないものはFirestoreから取得する) */
+func (s *Foon) resolveKeys(keys []*Key, slices interface{}) error {
 	value := reflect.Indirect(reflect.ValueOf(slices))
+	elemType := value.Type().Elem()
 
+	values := make([]reflect.Value, len(keys))
+	caches := map[string]*CacheResult{}
+	for i, key := range keys {
+		elem, src := newSliceElem(elemType)
+		values[i] = elem
+		caches[InstanceCache.CreateURIByKey(key).URI()] = &CacheResult{
+			Key:      key,
+			Src:      src,
+			HasCache: false,
+		}
+	}
 
-	var it *firestore.DocumentIterator = nil
-	var meta *CacheMetadata = nil
-	if conditions.group != "" {
-		col := parentKey.CreateGroupCollectionRef(s.client.Client())
-		query , err := conditions.Query(col.Query, s)
-		if err != nil {
+	if len(caches) > 0 {
+		if err := s.cache.GetMulti(caches); err != nil && NoSuchDocument.IsNot(err) {
 			return err
 		}
-		it = query.Documents(s)
-		meta = LoadGroupMetaData(s.cache, parentKey)
-	} else {
-		col := parentKey.CreateCollectionRef(s.client.Client())
-		query , err := conditions.Query(col.Query, s)
+	}
+
+	refs := []*firestore.DocumentRef{}
+	nonCaches := map[string]*CacheResult{}
+	for _, cache := range caches {
+		s.cache.countInstanceCache(cache.Key.Collection, cache.HasCache)
+		if !cache.HasCache {
+			refs = append(refs, cache.Key.CreateDocumentRef(s.client.Client()))
+			nonCaches[cache.Key.Path()] = cache
+		}
+	}
+
+	if len(refs) > 0 {
+		docs, err := s.client.GetAll(refs)
 		if err != nil {
 			return err
 		}
-		it = query.Documents(s)
-		meta = LoadMetadata(s.cache, parentKey)
+		for _, cache := range nonCaches {
+			s.cache.countFirestore(cache.Key.Collection, 1, 0, 0)
+		}
+		results := []*KeyAndData{}
+		for _, doc := range docs {
+			if !doc.Exists() {
+				// クエリ結果のドキュメントが削除されている
+				return NoSuchDocument
+			}
+			cache, ok := nonCaches[NewKeyWithPath(doc.Ref.Path).Path()]
+			if !ok {
+				continue
+			}
+			if err := doc.DataTo(cache.Src); err != nil {
+				return err
+			}
+			if err := cache.Key.Inject(cache.Src); err != nil {
+				return err
+			}
+			cache.HasCache = true
+			results = append(results, &KeyAndData{cache.Key, cache.Src})
+		}
+		s.cache.PutMulti(results)
 	}
 
+	for _, cache := range caches {
+		if !cache.HasCache {
+			return NoSuchDocument
+		}
+	}
+
+	slice := reflect.MakeSlice(value.Type(), 0, len(values))
+	for _, v := range values {
+		slice = reflect.Append(slice, v)
+	}
+	value.Set(slice)
+	return nil
+}
+
+func (s *Foon) getChildrenWithoutCache(parentKey *Key, slices interface{}, conditions *Conditions) error {
+	value := reflect.Indirect(reflect.ValueOf(slices))
 
+	var meta *CacheMetadata = nil
+	if conditions.group != "" {
+		meta = LoadGroupMetaData(s.cache, parentKey)
+	} else {
+		meta = LoadMetadata(s.cache, parentKey)
+	}
+	docs, err := s.queryDocuments(parentKey, conditions)
+	if err != nil {
+		return err
+	}
+
+	var cursor *Cursor
 	if conditions.cursor != nil {
-		s.cursor = conditions.cursor.NewCursorWithOrders()
+		cursor = conditions.cursor.NewCursorWithOrders()
+		defer s.setCursor(cursor)
 	}
-	// FIXME: カーソルでstartedAfterを使うとうまくいかない
+	// 実行時の状態は条件を使い回せるようにConditionsには持たせない
+	remaining := conditions.limit
 	var lastDoc *firestore.DocumentSnapshot = nil
 	var interfaces interface{} = nil
+	keys := []*Key{}
+	results := []*KeyAndData{}
 
-	for {
-		doc, err := it.Next()
-		conditions.limit--
-		if err != nil {
-			if err == iterator.Done {
-				break
-			}
-			s.logger.Warning(fmt.Sprintf("failed to get next (reason: %v)", err))
-			return err
-		}
+	for _, doc := range docs {
+		remaining--
 		lastDoc = doc
-		src := reflect.New(value.Type().Elem()).Interface()
+		elem, src := newSliceElem(value.Type().Elem())
 		interfaces = src
 		if err := doc.DataTo(src); err != nil {
 			return err
 		}
+		key := NewKeyWithPath(doc.Ref.Path)
+		if err := key.Inject(src); err != nil {
+			return err
+		}
 
-		value.Set(reflect.Append(value, reflect.Indirect(reflect.ValueOf(src))))
+		value.Set(reflect.Append(value, elem))
+		keys = append(keys, key)
+		results = append(results, &KeyAndData{key, src})
 	}
 
-	dst := value.Interface()
+	if s.shouldPopulate() && len(results) > 0 {
+		if err := s.cache.PutMulti(results); err != nil {
+			s.warningf("failed to populate instance cache (reason: %v)", err)
+		}
+	}
 
-	meta.Put(conditions.URI(parentKey), dst)
+	if s.queryCacheMode == QueryCacheKeys {
+		meta.Describe(newQueryDescriptor(conditions, true, conditions.KeysURI(parentKey), conditions.CursorURI(parentKey)))
+		meta.Put(conditions.KeysURI(parentKey), keys)
+	} else {
+		meta.Describe(newQueryDescriptor(conditions, false, conditions.URI(parentKey), conditions.CursorURI(parentKey)))
+		meta.Put(conditions.URI(parentKey), value.Interface())
+	}
 
-	if lastDoc != nil && interfaces != nil && conditions.limit <= 0 && conditions.cursor != nil{
-		s.cursor.ID = getIdField(reflect.ValueOf(interfaces))
-		s.logger.Trace(fmt.Sprintf("this is ok : %s : %+v", s.cursor.ID, value))
-		s.cursor.Path = NewKeyWithPath(lastDoc.Ref.Path).Path()
+	if lastDoc != nil && interfaces != nil && remaining <= 0 && conditions.cursor != nil{
+		cursor.ID = getIdField(reflect.ValueOf(interfaces))
+		cursor.Path = NewKeyWithPath(lastDoc.Ref.Path).Path()
+		// 次のページを値で指定できるように並び順のフィールドの値を保持する (最後のドキュメントが削除されても使える)
+		cursor.setValues(lastDoc)
+		cursor.Fingerprint = conditions.fingerprint(parentKey)
 
-		meta.Put(conditions.CursorURI(parentKey), s.cursor)
+		meta.Put(conditions.CursorURI(parentKey), cursor)
 	}
 
 	return nil
 }
 
+/** 条件の実行計画に従ってドキュメントを取得する */
+func (s *Foon) queryDocuments(parentKey *Key, conditions *Conditions) ([]*firestore.DocumentSnapshot, error) {
+	if err := conditions.Validate(); err != nil {
+		return nil, err
+	}
+	plan := conditions.plan()
+	docs := []*firestore.DocumentSnapshot{}
+	for _, sub := range plan.queries {
+		var col firestore.Query
+		if conditions.group != "" {
+			col = parentKey.CreateGroupCollectionRef(s.client.Client()).Query
+		} else {
+			col = parentKey.CreateCollectionRef(s.client.Client()).Query
+		}
+		query, err := sub.Query(col, s)
+		if err != nil {
+			return nil, err
+		}
+		it := query.Documents(s)
+		count := 0
+		for {
+			doc, err := it.Next()
+			if err != nil {
+				if err == iterator.Done {
+					break
+				}
+				s.logger.Warn(fmt.Sprintf("failed to get next (reason: %v)", err))
+				return nil, err
+			}
+			count++
+			s.cache.countFirestore(parentKey.Collection, 1, 0, 0)
+			// 読み込み中に上限を超えた場合は残りを読まずに中断する
+			if err := s.checkBudget(); err != nil {
+				it.Stop()
+				return nil, err
+			}
+			docs = append(docs, doc)
+		}
+		if count == 0 {
+			s.cache.countEmptyQuery()
+		}
+	}
+	return plan.merge(docs), nil
+}
+
 func (s *Foon) LastCursor() string {
-	if s.cursor == nil {
-		s.logger.Trace("cursor is nil")
+	cursor := s.lastCursor()
+	if cursor == nil {
+		s.logger.Debug("cursor is nil")
 		return ""
 	}
-	if s.cursor.ID == "" {
-		s.logger.Trace("id is empty")
+	if cursor.ID == "" {
+		s.logger.Debug("id is empty")
 		return ""
 	}
-	if s.cursor.Path == "" {
-		s.logger.Trace("cursor path is empty")
+	if cursor.Path == "" {
+		s.logger.Debug("cursor path is empty")
 		return ""
 	}
-	return s.cursor.String()
+	return s.encodeCursor(cursor)
+}
+
+func (s *Foon) lastCursor() *Cursor {
+	if s.cursor == nil {
+		return nil
+	}
+	s.cursor.mu.Lock()
+	defer s.cursor.mu.Unlock()
+	return s.cursor.cursor
+}
+
+func (s *Foon) setCursor(cursor *Cursor) {
+	if s.cursor == nil {
+		return
+	}
+	s.cursor.mu.Lock()
+	defer s.cursor.mu.Unlock()
+	s.cursor.cursor = cursor
+}
+
+/** 設定されたCursorCodec (未設定の場合はキャッシュのKeyProviderから作る。どちらもない場合はnil) */
+func (s *Foon) codec() *CursorCodec {
+	if s.cursorCodec != nil {
+		return s.cursorCodec
+	}
+	if s.cache != nil && s.cache.keys != nil {
+		return NewCursorCodec(s.cache.keys)
+	}
+	return nil
+}
+
+func (s *Foon) encodeCursor(cursor *Cursor) string {
+	codec := s.codec()
+	if codec == nil {
+		return cursor.String()
+	}
+	token, err := codec.Encode(cursor)
+	if err != nil {
+		s.logger.Warn("failed to encode cursor", F("reason", err))
+		return ""
+	}
+	return token
+}
+
+/** LastCursorで取得した文字列からカーソルを復元する */
+func (s *Foon) ParseCursor(cursor string) (*Cursor, error) {
+	codec := s.codec()
+	if codec == nil {
+		return NewCursor(cursor)
+	}
+	return codec.Decode(cursor)
 }
 
 func (s *Foon) GetWithoutCache(src interface{}) error {
@@ -566,17 +1080,31 @@ func (s *Foon) GetWithoutCache(src interface{}) error {
 		return errors.New("Get method must be spesified ID")
 	}
 
-	return s.getWithoutCache(info, src)
+	return s.intercept(&Operation{Kind: GetOperation, Keys: []*Key{newKey(info)}, dst: src}, func(s *Foon) error {
+		return s.getWithoutCache(info, src)
+	})
 }
 
 func (s *Foon) RunInTransaction(fn func(f *Foon) error, options ...firestore.TransactionOption) error {
-	return s.client.RunTransaction(func(ctx context.Context, fs *firestore.Transaction) error {
-		newFoon := newStoreWithTransaction(s, ctx, fs)
-		return fn(newFoon)
-	}, options...)
+	return s.intercept(&Operation{Kind: TransactionOperation}, func(s *Foon) error {
+		return s.client.RunTransaction(func(ctx context.Context, fs *firestore.Transaction) error {
+			newFoon := newStoreWithTransaction(s, ctx, fs)
+			return fn(newFoon)
+		}, options...)
+	})
 }
 
+/** Commit時にInterceptorを通るWriteBatchを作成する */
 func (s *Foon) Batch() (WriteBatch, error) {
+	batch, err := s.newBatch()
+	if err != nil {
+		return nil, err
+	}
+	batch.foon = s
+	return batch, nil
+}
+
+func (s *Foon) newBatch() (*WriteBatchImpl, error) {
 	batch, err := s.client.Batch()
 	if err != nil {
 		return nil, err
@@ -597,17 +1125,18 @@ func (s *Foon) getWithoutCache(info *fields, src interface{}) error {
 	err := s.execute(func(client FirestoreClient) error {
 		key := newKey(info)
 		docRef := key.CreateDocumentRef(client.Client())
-		s.logger.Trace(fmt.Sprintf("try to get firestore (path: %s)", docRef.Path))
+		s.logger.Debug("try to get firestore", F("path", docRef.Path))
 		doc, err := docRef.Get(s)
+		s.cache.countFirestore(key.Collection, 1, 0, 0)
 		if err != nil {
 			if doc != nil && doc.Exists() == false {
-				s.logger.Trace("not found")
+				s.logger.Debug("not found")
 				return NoSuchDocument
 			}
-			s.logger.Warning(fmt.Sprintf("failed to get document (reason:%v)", err))
+			s.logger.Warn("failed to get document", F("path", docRef.Path), F("reason", err))
 			return err
 		}
-		s.logger.Trace(fmt.Sprintf("get firestore (path: %s, exists: %v)", docRef.Path, doc.Exists()))
+		s.logger.Debug("get firestore", F("path", docRef.Path), F("exists", doc.Exists()))
 		info.updateKey(docRef)
 
 		return doc.DataTo(src)
@@ -618,6 +1147,35 @@ func (s *Foon) getWithoutCache(info *fields, src interface{}) error {
 	return s.setMemcache(info, src)
 }
 
+/** キャッシュの値と保存されている値を比較する (SetCacheVerificationが有効な場合のみ) */
+func (s *Foon) verifyCached(key *Key, cached interface{}) {
+	if !s.verifyCache {
+		return
+	}
+	doc, err := key.CreateDocumentRef(s.client.Client()).Get(s)
+	s.cache.countFirestore(key.Collection, 1, 0, 0)
+	if err != nil {
+		if doc != nil && !doc.Exists() {
+			s.warningf("cache is stale: document is not found (path: %s)", key.Path())
+		}
+		return
+	}
+	stored := reflect.New(reflect.Indirect(reflect.ValueOf(cached)).Type()).Interface()
+	if err := doc.DataTo(stored); err != nil {
+		return
+	}
+	if err := key.Inject(stored); err != nil {
+		return
+	}
+	normalized, ok := normalizeForCache(stored)
+	if !ok {
+		return
+	}
+	if diffs := diffFields(cached, normalized); len(diffs) > 0 {
+		s.warningf("cache differs from store (path: %s, fields: %v)", key.Path(), diffs)
+	}
+}
+
 func (s *Foon) execute(fn func(client FirestoreClient) error) error {
 
 	if err := fn(s.client); err != nil {
@@ -627,10 +1185,10 @@ func (s *Foon) execute(fn func(client FirestoreClient) error) error {
 	return nil
 }
 
+/** Firestoreへの書き込みは成功しているので、キャッシュの保存に失敗してもエラーにしない */
 func (s *Foon) setMemcache(info *fields, src interface{}) error {
 	if err := s.cache.Put(newKey(info), src); err != nil {
 		s.warningf("failed to Put Memcached %+v", err)
-		return err
 	}
 	return nil
 }
@@ -642,19 +1200,29 @@ func (s *Foon) setMemcacheMulti(res []*KeyAndData) error {
 func (s *Foon) setMemcacheWithKey(key string, src interface{}) error {
 	if err := s.cache.PutCache(key, src); err != nil {
 		s.warningf("failed to Put Memcached %+v", err)
-		return err
 	}
 	return nil
 }
 
 func (s *Foon) Delete(src interface{}) error {
 	key := NewKey(src)
-	s.cache.Delete(key)
+	return s.intercept(&Operation{Kind: DeleteOperation, Keys: []*Key{key}}, func(s *Foon) error {
+		if s.uow != nil {
+			s.uow.delete(key)
+			return nil
+		}
+		old, known := loadCachedEntity(s.cache, key, src)
+		s.cache.Delete(key)
+		s.cache.metrics.invalidated(key.Collection, 1)
 
-	LoadMetadata(s.cache, key).DeleteAll()
-	LoadGroupMetaData(s.cache, key).DeleteAll()
+		invalidateQueries(s.cache, key, []entityChange{{old, nil, known}})
 
-	return s.client.Delete(key.CreateDocumentRef(s.client.Client()))
+		if err := s.client.Delete(key.CreateDocumentRef(s.client.Client())); err != nil {
+			return err
+		}
+		s.cache.countFirestore(key.Collection, 0, 0, 1)
+		return nil
+	})
 }
 
 func (s *Foon) tracef(format string, args ...interface{}) {
@@ -665,6 +1233,25 @@ func (s *Foon) warningf(format string, args ...interface{}) {
 	warningf(s.logger, format, args...)
 }
 
+/** スライスの各要素のKey (Operationに渡す) */
+func sliceKeys(value reflect.Value) []*Key {
+	keys := []*Key{}
+	for i := 0; i < value.Len(); i++ {
+		keys = append(keys, NewKey(value.Index(i).Interface()))
+	}
+	return keys
+}
+
+/** スライスの要素を新たに作成し、追加用の値とデコード先のポインタを返す */
+func newSliceElem(elemType reflect.Type) (reflect.Value, interface{}) {
+	if elemType.Kind() == reflect.Ptr {
+		ptr := reflect.New(elemType.Elem())
+		return ptr, ptr.Interface()
+	}
+	ptr := reflect.New(elemType)
+	return ptr.Elem(), ptr.Interface()
+}
+
 func (s *Foon) validSlice(src interface{}) error {
 	if reflect.ValueOf(src).Kind() != reflect.Ptr {
 		return errors.New("src must be slice pointer.")
@@ -883,3 +883,208 @@ func TestFoon_GetGroupByQuery_複数(t *testing.T) {
 	}
 
 }
+
+func Test_QueryCacheKeys_Keyのみのキャッシュから取得できる(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8915")
+	store, err := NewStoreWithProjectID(ctx, "everychart-dev")
+
+	if err != nil {
+		t.Fatalf("failed to create Foon Client (reason: %v)", err)
+	}
+	store.SetQueryCacheMode(QueryCacheKeys)
+
+	users := []*TestUser{
+		{UserID: "keys001", UserName: "keysname", Age: 1},
+		{UserID: "keys002", UserName: "keysname", Age: 2},
+	}
+
+	if err := store.PutMulti(&users); err != nil {
+		t.Fatalf("failed to put test data.")
+	}
+
+	key := NewKey(&TestUser{})
+	results := []*TestUser{}
+	cond := NewConditions().Where("userName", "==", "keysname").OrderBy("age", firestore.Asc)
+
+	if err := store.GetByQuery(key, &results, cond); err != nil {
+		t.Fatalf("failed to get data (reason: %v)", err)
+	}
+
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "keys001", results[0].UserID)
+	assert.Equal(t, "keys002", results[1].UserID)
+
+	// Keyのみキャッシュされているので、エンティティはInstanceCacheから解決される
+	results = []*TestUser{}
+	if err := store.GetByQuery(key, &results, cond); err != nil {
+		t.Fatalf("failed to get data (reason: %v)", err)
+	}
+
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "keys001", results[0].UserID)
+	assert.Equal(t, 1, results[0].Age)
+	assert.Equal(t, "keys002", results[1].UserID)
+	assert.Equal(t, 2, results[1].Age)
+}
+
+func Test_PopulateAlways_クエリ結果がInstanceCacheに書き込まれる(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8915")
+	store, err := NewStoreWithProjectID(ctx, "everychart-dev")
+
+	if err != nil {
+		t.Fatalf("failed to create Foon Client (reason: %v)", err)
+	}
+	store.SetCachePopulatePolicy(PopulateAlways)
+
+	users := []*TestUser{
+		{UserID: "populate001", UserName: "populatename", Age: 1},
+		{UserID: "populate002", UserName: "populatename", Age: 2},
+	}
+
+	if err := store.PutMulti(&users); err != nil {
+		t.Fatalf("failed to put test data.")
+	}
+	for _, user := range users {
+		store.cache.Delete(NewKey(user))
+	}
+
+	results := []*TestUser{}
+	if err := store.GetByQueryWithoutCache(NewKey(&TestUser{}), &results, NewConditions().Where("userName", "==", "populatename")); err != nil {
+		t.Fatalf("failed to get data (reason: %v)", err)
+	}
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "populate001", results[0].UserID)
+
+	cached := &TestUser{}
+	if err := store.cache.Get(NewKey(users[0]), cached); err != nil {
+		t.Fatalf("failed to get cache (reason: %v)", err)
+	}
+	assert.Equal(t, "populate001", cached.UserID)
+	assert.Equal(t, "populatename", cached.UserName)
+}
+
+func Test_UnitOfWork_同じKeyは同じポインタを返しFlushでまとめて書き込む(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8915")
+	store, err := NewStoreWithProjectID(ctx, "everychart-dev")
+
+	if err != nil {
+		t.Fatalf("failed to create Foon Client (reason: %v)", err)
+	}
+
+	if err := store.Put(&TestUser{UserID: "uow001", UserName: "before"}); err != nil {
+		t.Fatalf("failed to put user (reason: %v)", err)
+	}
+
+	store.BeginUnitOfWork()
+
+	first, err := store.GetTracked(&TestUser{UserID: "uow001"})
+	if err != nil {
+		t.Fatalf("failed to get user (reason: %v)", err)
+	}
+	second, err := store.GetTracked(&TestUser{UserID: "uow001"})
+	if err != nil {
+		t.Fatalf("failed to get user (reason: %v)", err)
+	}
+	assert.True(t, first == second)
+
+	user := first.(*TestUser)
+	user.UserName = "after"
+	if err := store.Put(user); err != nil {
+		t.Fatalf("failed to put user (reason: %v)", err)
+	}
+	created := &TestUser{UserName: "created"}
+	if err := store.Put(created); err != nil {
+		t.Fatalf("failed to put user (reason: %v)", err)
+	}
+	assert.NotEqual(t, "", created.UserID)
+	assert.True(t, store.HasChanges())
+
+	// Flushするまでは書き込まれない
+	stored := &TestUser{UserID: "uow001"}
+	if err := store.GetWithoutCache(stored); err != nil {
+		t.Fatalf("failed to get user (reason: %v)", err)
+	}
+	assert.Equal(t, "before", stored.UserName)
+
+	if err := store.Flush(); err != nil {
+		t.Fatalf("failed to flush (reason: %v)", err)
+	}
+	assert.False(t, store.HasChanges())
+
+	if err := store.GetWithoutCache(stored); err != nil {
+		t.Fatalf("failed to get user (reason: %v)", err)
+	}
+	assert.Equal(t, "after", stored.UserName)
+
+	createdStored := &TestUser{UserID: created.UserID}
+	if err := store.GetWithoutCache(createdStored); err != nil {
+		t.Fatalf("failed to get user (reason: %v)", err)
+	}
+	assert.Equal(t, "created", createdStored.UserName)
+
+	// Deleteも Flush するまでは書き込まれない
+	if err := store.Delete(created); err != nil {
+		t.Fatalf("failed to delete user (reason: %v)", err)
+	}
+	assert.Equal(t, NoSuchDocument, store.Get(&TestUser{UserID: created.UserID}))
+	if err := store.GetWithoutCache(createdStored); err != nil {
+		t.Fatalf("failed to get user (reason: %v)", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("failed to flush (reason: %v)", err)
+	}
+	assert.Error(t, store.GetWithoutCache(&TestUser{UserID: created.UserID}))
+
+	store.EndUnitOfWork()
+	assert.Nil(t, store.Tracked(NewKey(user)))
+}
+
+func Test_UnitOfWork_GetMultiは書き込み前の変更を反映する(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	server.addUser("user001", "foo", 20)
+	server.addUser("user002", "bar", 30)
+	s := newFakeStore(t, server)
+	logger := &recordLogger{}
+	s.SetLogger(logger)
+	s.BeginUnitOfWork()
+
+	loaded := []*TestUser{{UserID: "user001"}, {UserID: "user002"}}
+	assert.NoError(t, s.GetMulti(&loaded))
+	loaded[0].UserName = "changed"
+	assert.NoError(t, s.Put(loaded[0]))
+	assert.NoError(t, s.Insert(&TestUser{UserID: "user003", UserName: "baz"}))
+	assert.NoError(t, s.Delete(&TestUser{UserID: "user002"}))
+	gets := len(server.gets)
+
+	users := []*TestUser{{UserID: "user001"}, {UserID: "user003"}}
+	assert.NoError(t, s.GetMulti(&users))
+	assert.Equal(t, "changed", users[0].UserName)
+	assert.Equal(t, "baz", users[1].UserName)
+	assert.True(t, users[0] == loaded[0])
+
+	// 削除予定のエンティティは取得できない
+	users = []*TestUser{{UserID: "user001"}, {UserID: "user002"}}
+	assert.Equal(t, NoSuchDocument, s.GetMulti(&users))
+	assert.Equal(t, gets, len(server.gets))
+
+	// ポインタのスライスでなければ値はコピーするが追跡できない
+	values := []TestUser{{UserID: "user001"}}
+	assert.NoError(t, s.GetMulti(&values))
+	assert.Equal(t, "changed", values[0].UserName)
+	assert.NotEmpty(t, logger.warnings)
+}
@@ -0,0 +1,455 @@
+package foon
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+/** キャッシュしたクエリの条件 (書き込み時にクエリ結果が変わり得るかを判定するために保持する) */
+type QueryDescriptor struct {
+	URIs     []string
+	Filters  []FilterDescriptor
+	Orders   []string
+	KeysOnly bool
+}
+
+type FilterDescriptor struct {
+	Column    string
+	Operation string
+	Value     FieldValue
+}
+
+/** 比較用に正規化したフィールドの値 (gobでそのまま保存できる形にしておく) */
+type FieldValue struct {
+	Kind   FieldKind
+	Bool   bool
+	Int    int64
+	Float  float64
+	String string
+	Time   time.Time
+	List   []FieldValue
+}
+
+type FieldKind int
+
+const (
+	UnknownKind FieldKind = iota
+	NullKind
+	BoolKind
+	IntKind
+	FloatKind
+	StringKind
+	TimeKind
+	ListKind
+)
+
+/** 書き込みによるエンティティの変更 (Knownがfalseの場合は変更前の値が不明) */
+type entityChange struct {
+	Old   interface{}
+	New   interface{}
+	Known bool
+}
+
+func newQueryDescriptor(conditions *Conditions, keysOnly bool, uris ...IURI) *QueryDescriptor {
+	desc := &QueryDescriptor{
+		URIs:     []string{},
+		Filters:  []FilterDescriptor{},
+		Orders:   []string{},
+		KeysOnly: keysOnly,
+	}
+	for _, uri := range uris {
+		desc.URIs = append(desc.URIs, uri.URI())
+	}
+	for _, q := range conditions.Queries {
+		switch query := q.(type) {
+		case Where:
+			desc.Filters = append(desc.Filters, FilterDescriptor{query.Column, query.Operation, newFieldValue(query.Value)})
+		case Order:
+			desc.Orders = append(desc.Orders, query.Column)
+		}
+	}
+	cursor := conditions.cursor
+	if cursor == nil {
+		cursor = conditions.documentCursor()
+	}
+	if cursor != nil {
+		for _, order := range cursor.Orders {
+			desc.Orders = append(desc.Orders, order.FieldName)
+		}
+	}
+	return desc
+}
+
+/** 変更によってクエリ結果が変わり得る場合にtrueを返す */
+func (d *QueryDescriptor) Affected(change entityChange) bool {
+	if !change.Known {
+		return true
+	}
+	matchOld, ok := d.matches(change.Old)
+	if !ok {
+		return true
+	}
+	matchNew, ok := d.matches(change.New)
+	if !ok {
+		return true
+	}
+	if !matchOld && !matchNew {
+		return false
+	}
+	if matchOld && matchNew && d.KeysOnly {
+		// Keyのみ保持している場合は並び順が変わらなければ結果は変わらない
+		return !d.sameOrders(change.Old, change.New)
+	}
+	return true
+}
+
+func (d *QueryDescriptor) matches(entity interface{}) (bool, bool) {
+	if entity == nil {
+		return false, true
+	}
+	for _, filter := range d.Filters {
+		value, found := lookupFieldValue(entity, filter.Column)
+		if !found {
+			return false, false
+		}
+		match, ok := filter.match(value)
+		if !ok {
+			return false, false
+		}
+		if !match {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+func (d *QueryDescriptor) sameOrders(old, new interface{}) bool {
+	for _, column := range d.Orders {
+		oldValue, found := lookupFieldValue(old, column)
+		if !found {
+			return false
+		}
+		newValue, found := lookupFieldValue(new, column)
+		if !found {
+			return false
+		}
+		if cmp, ok := oldValue.compare(newValue); !ok || cmp != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f FilterDescriptor) match(value FieldValue) (bool, bool) {
+	switch f.Operation {
+	case "==":
+		return value.equals(f.Value)
+	case "!=":
+		eq, ok := value.equals(f.Value)
+		return !eq, ok
+	case "<", "<=", ">", ">=":
+		if !value.comparable(f.Value) {
+			return false, value.Kind != UnknownKind && f.Value.Kind != UnknownKind
+		}
+		cmp, ok := value.compare(f.Value)
+		if !ok {
+			return false, false
+		}
+		switch f.Operation {
+		case "<":
+			return cmp < 0, true
+		case "<=":
+			return cmp <= 0, true
+		case ">":
+			return cmp > 0, true
+		}
+		return cmp >= 0, true
+	case "in":
+		return f.Value.contains(value)
+	case "not-in":
+		in, ok := f.Value.contains(value)
+		return !in, ok
+	case "array-contains":
+		return value.contains(f.Value)
+	case "array-contains-any":
+		if f.Value.Kind != ListKind {
+			return false, false
+		}
+		for _, v := range f.Value.List {
+			in, ok := value.contains(v)
+			if !ok {
+				return false, false
+			}
+			if in {
+				return true, true
+			}
+		}
+		return false, true
+	}
+	return false, false
+}
+
+func newFieldValue(src interface{}) FieldValue {
+	if src == nil {
+		return FieldValue{Kind: NullKind}
+	}
+	return newFieldValueOf(reflect.ValueOf(src))
+}
+
+func newFieldValueOf(value reflect.Value) FieldValue {
+	if !value.IsValid() {
+		return FieldValue{Kind: NullKind}
+	}
+	if value.Type() == reflect.TypeOf(time.Time{}) {
+		if !value.CanInterface() {
+			return FieldValue{Kind: UnknownKind}
+		}
+		return FieldValue{Kind: TimeKind, Time: value.Interface().(time.Time)}
+	}
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return FieldValue{Kind: NullKind}
+		}
+		return newFieldValueOf(value.Elem())
+	case reflect.Bool:
+		return FieldValue{Kind: BoolKind, Bool: value.Bool()}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return FieldValue{Kind: IntKind, Int: value.Int()}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return FieldValue{Kind: IntKind, Int: int64(value.Uint())}
+	case reflect.Float32, reflect.Float64:
+		return FieldValue{Kind: FloatKind, Float: value.Float()}
+	case reflect.String:
+		return FieldValue{Kind: StringKind, String: value.String()}
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return FieldValue{Kind: UnknownKind}
+		}
+		list := []FieldValue{}
+		for i := 0; i < value.Len(); i++ {
+			list = append(list, newFieldValueOf(value.Index(i)))
+		}
+		return FieldValue{Kind: ListKind, List: list}
+	}
+	return FieldValue{Kind: UnknownKind}
+}
+
+/** クエリの値として使える形に戻す */
+func (v FieldValue) value() interface{} {
+	switch v.Kind {
+	case BoolKind:
+		return v.Bool
+	case IntKind:
+		return v.Int
+	case FloatKind:
+		return v.Float
+	case StringKind:
+		return v.String
+	case TimeKind:
+		return v.Time
+	case ListKind:
+		list := []interface{}{}
+		for _, item := range v.List {
+			list = append(list, item.value())
+		}
+		return list
+	}
+	return nil
+}
+
+func (v FieldValue) isNumber() bool {
+	return v.Kind == IntKind || v.Kind == FloatKind
+}
+
+func (v FieldValue) float() float64 {
+	if v.Kind == IntKind {
+		return float64(v.Int)
+	}
+	return v.Float
+}
+
+func (v FieldValue) comparable(other FieldValue) bool {
+	if v.isNumber() && other.isNumber() {
+		return true
+	}
+	return v.Kind == other.Kind && v.Kind != UnknownKind && v.Kind != ListKind
+}
+
+/** 大小を比較する (比較できない場合は2番目の戻り値がfalse) */
+func (v FieldValue) compare(other FieldValue) (int, bool) {
+	if !v.comparable(other) {
+		return 0, false
+	}
+	switch {
+	case v.Kind == IntKind && other.Kind == IntKind:
+		return compareInt64(v.Int, other.Int), true
+	case v.isNumber():
+		a, b := v.float(), other.float()
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	case v.Kind == StringKind:
+		return strings.Compare(v.String, other.String), true
+	case v.Kind == BoolKind:
+		if v.Bool == other.Bool {
+			return 0, true
+		} else if !v.Bool {
+			return -1, true
+		}
+		return 1, true
+	case v.Kind == TimeKind:
+		// Firestoreはマイクロ秒までしか保持しない
+		a, b := v.Time.Truncate(time.Microsecond), other.Time.Truncate(time.Microsecond)
+		if a.Before(b) {
+			return -1, true
+		} else if a.After(b) {
+			return 1, true
+		}
+		return 0, true
+	case v.Kind == NullKind:
+		return 0, true
+	}
+	return 0, false
+}
+
+func (v FieldValue) equals(other FieldValue) (bool, bool) {
+	if v.Kind == UnknownKind || other.Kind == UnknownKind {
+		return false, false
+	}
+	if v.Kind == ListKind || other.Kind == ListKind {
+		if v.Kind != other.Kind || len(v.List) != len(other.List) {
+			return false, true
+		}
+		for i := range v.List {
+			eq, ok := v.List[i].equals(other.List[i])
+			if !ok || !eq {
+				return eq, ok
+			}
+		}
+		return true, true
+	}
+	if !v.comparable(other) {
+		return false, true
+	}
+	cmp, ok := v.compare(other)
+	return cmp == 0, ok
+}
+
+func (v FieldValue) contains(other FieldValue) (bool, bool) {
+	if v.Kind != ListKind {
+		return false, v.Kind != UnknownKind
+	}
+	for _, item := range v.List {
+		eq, ok := item.equals(other)
+		if !ok {
+			return false, false
+		}
+		if eq {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+/** Firestoreのフィールド名(ドット区切り)からエンティティの値を取得する */
+func lookupFieldValue(entity interface{}, column string) (FieldValue, bool) {
+	value := reflect.ValueOf(entity)
+	for _, name := range strings.Split(column, ".") {
+		next, ok := lookupField(value, name)
+		if !ok {
+			return FieldValue{}, false
+		}
+		value = next
+	}
+	return newFieldValueOf(value), true
+}
+
+func lookupField(value reflect.Value, name string) (reflect.Value, bool) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return reflect.Value{}, false
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}, false
+		}
+		item := value.MapIndex(reflect.ValueOf(name).Convert(value.Type().Key()))
+		if !item.IsValid() {
+			return reflect.Value{}, false
+		}
+		return item, true
+	case reflect.Struct:
+		types := value.Type()
+		for i := 0; i < types.NumField(); i++ {
+			field := types.Field(i)
+			if field.PkgPath != "" && !field.Anonymous {
+				continue
+			}
+			tag := strings.Split(field.Tag.Get("firestore"), ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if field.Anonymous && tag == "" {
+				if v, ok := lookupField(value.Field(i), name); ok {
+					return v, true
+				}
+				continue
+			}
+			fieldName := field.Name
+			if tag != "" {
+				fieldName = tag
+			}
+			if fieldName == name {
+				return value.Field(i), true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+/** 書き込まれたKeyのコレクション(とコレクショングループ)のクエリキャッシュを無効化し、ローカルキャッシュの世代を進める */
+func invalidateQueries(cache *FirestoreCache, key *Key, changes []entityChange) {
+	if cache.local != nil {
+		cache.local.bumpGeneration(cache, key.Collection)
+	}
+	metadata := LoadMetadata(cache, key)
+	before := len(metadata.Item.Data)
+	if err := metadata.Invalidate(changes); err != nil {
+		warningf(cache.logger, "failed to invalidate metadata (reason: %v)", err)
+	}
+	group := LoadGroupMetaData(cache, key)
+	groupBefore := len(group.Item.Data)
+	if err := group.Invalidate(changes); err != nil {
+		warningf(cache.logger, "failed to invalidate group metadata (reason: %v)", err)
+	}
+	cache.metrics.invalidated(key.Collection, before-len(metadata.Item.Data)+groupBefore-len(group.Item.Data))
+}
+
+/** 変更前のエンティティをInstanceCacheから取得する (取得できなかった場合はfalse) */
+func loadCachedEntity(cache *FirestoreCache, key *Key, src interface{}) (interface{}, bool) {
+	if !key.HasUniqueID() {
+		return nil, false
+	}
+	old := reflect.New(reflect.Indirect(reflect.ValueOf(src)).Type()).Interface()
+	if err := cache.Get(key, old); err != nil {
+		return nil, false
+	}
+	return old, true
+}
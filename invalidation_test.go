@@ -0,0 +1,59 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQueryDescriptor_Affected(t *testing.T) {
+	cond := NewConditions().Where("userName", "==", "kazuki").Where("age", ">=", 20)
+	desc := newQueryDescriptor(cond, false, ConditionURI("query"))
+
+	matched := &TestUser{UserName: "kazuki", Age: 20}
+	other := &TestUser{UserName: "other", Age: 30}
+	young := &TestUser{UserName: "kazuki", Age: 19}
+
+	// 条件に一致しないエンティティの変更は影響しない
+	assert.False(t, desc.Affected(entityChange{other, &TestUser{UserName: "other", Age: 40}, true}))
+	assert.False(t, desc.Affected(entityChange{nil, young, true}))
+
+	// 一致するエンティティの追加・削除・更新は影響する
+	assert.True(t, desc.Affected(entityChange{nil, matched, true}))
+	assert.True(t, desc.Affected(entityChange{matched, nil, true}))
+	assert.True(t, desc.Affected(entityChange{young, matched, true}))
+	assert.True(t, desc.Affected(entityChange{matched, &TestUser{UserName: "kazuki", Age: 21}, true}))
+
+	// 変更前が不明な場合は常に影響する
+	assert.True(t, desc.Affected(entityChange{nil, other, false}))
+}
+
+func TestQueryDescriptor_Keysのみの場合は並び順が変わらなければ影響しない(t *testing.T) {
+	cond := NewConditions().Where("userName", "==", "kazuki").OrderBy("age", firestore.Asc)
+	desc := newQueryDescriptor(cond, true, ConditionURI("query"))
+
+	before := &TestUser{UserID: "a", UserName: "kazuki", Age: 20}
+	renamed := &TestUser{UserID: "a", UserName: "kazuki", Age: 20}
+	older := &TestUser{UserID: "a", UserName: "kazuki", Age: 21}
+
+	assert.False(t, desc.Affected(entityChange{before, renamed, true}))
+	assert.True(t, desc.Affected(entityChange{before, older, true}))
+}
+
+func TestQueryDescriptor_配列の条件(t *testing.T) {
+	type Tagged struct {
+		Tags []string `firestore:"tags"`
+		Num  int      `firestore:"num"`
+	}
+	contains := newQueryDescriptor(NewConditions().Where("tags", "array-contains", "go"), false)
+	assert.True(t, contains.Affected(entityChange{nil, &Tagged{Tags: []string{"go"}}, true}))
+	assert.False(t, contains.Affected(entityChange{nil, &Tagged{Tags: []string{"rust"}}, true}))
+
+	in := newQueryDescriptor(NewConditions().Where("num", "in", []int{1, 2}), false)
+	assert.True(t, in.Affected(entityChange{nil, &Tagged{Num: 2}, true}))
+	assert.False(t, in.Affected(entityChange{nil, &Tagged{Num: 3}, true}))
+
+	// 存在しないフィールドは判定できないので影響ありとする
+	unknown := newQueryDescriptor(NewConditions().Where("missing", "==", 1), false)
+	assert.True(t, unknown.Affected(entityChange{nil, &Tagged{}, true}))
+}
@@ -104,18 +104,16 @@ func (k *Key) ParentKey() *Key {
 
 func (k *Key) Inject(src interface{}) error {
 	if info, ok := src.(*fields); ok {
-		 k.injectFields(info)
-		 return nil
+		return k.injectFields(info)
 	}
 	info, err := newFields(src)
 	if err != nil {
 		return err
 	}
-	k.injectFields(info)
-	return nil
+	return k.injectFields(info)
 }
 
-func (k *Key) injectFields(field *fields) {
+func (k *Key) injectFields(field *fields) error {
 	field.self = k
 	if field.parent != nil {
 		key := k.ParentKey()
@@ -123,8 +121,9 @@ func (k *Key) injectFields(field *fields) {
 		field.parent.field.Set(reflect.ValueOf(key))
 	}
 	if field.id != nil {
-		field.id.SetID(k.ID)
+		return field.id.SetID(k.ID)
 	}
+	return nil
 }
 
 func (k *Key) IsSameKind(src interface{}) bool {
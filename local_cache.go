@@ -0,0 +1,191 @@
+package foon
+
+import (
+	"container/list"
+	"context"
+	"google.golang.org/appengine/memcache"
+	"sync"
+	"time"
+)
+
+/** 他インスタンスの書き込みを検知するための世代番号のキー (コレクション毎) */
+const generationCacheKey = "foon/generation"
+
+/**
+ * Memcacheの手前に置くプロセス内のLRUキャッシュ
+ * InstanceCacheのURIをキーにエンコード済みの値を保持する。
+ * 複数のリクエストで共有するため、パッケージ変数などで1つだけ作成して使う。
+ */
+type LocalCache struct {
+	mu          sync.Mutex
+	maxEntries  int
+	maxBytes    int
+	ttl         time.Duration
+	refresh     time.Duration
+	entries     *list.List
+	items       map[string]*list.Element
+	bytes       int
+	generations map[string]uint64
+	checkedAt   map[string]time.Time
+}
+
+type localEntry struct {
+	collection string
+	key        string
+	value      []byte
+	expires    time.Time
+}
+
+func NewLocalCache(maxEntries int, maxBytes int, ttl time.Duration) *LocalCache {
+	return &LocalCache{
+		maxEntries:  maxEntries,
+		maxBytes:    maxBytes,
+		ttl:         ttl,
+		refresh:     time.Second,
+		entries:     list.New(),
+		items:       map[string]*list.Element{},
+		generations: map[string]uint64{},
+		checkedAt:   map[string]time.Time{},
+	}
+}
+
+/** 世代番号(他インスタンスの書き込み)を確認する間隔を設定する */
+func (l *LocalCache) SetRefreshInterval(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refresh = interval
+}
+
+func (l *LocalCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entries.Len()
+}
+
+func (l *LocalCache) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purge()
+}
+
+func (l *LocalCache) get(ctx context.Context, collection string, key string) ([]byte, bool) {
+	l.checkGeneration(ctx, collection)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*localEntry)
+	if l.ttl > 0 && time.Now().After(entry.expires) {
+		l.removeElement(elem)
+		return nil, false
+	}
+	l.entries.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (l *LocalCache) set(collection string, key string, value []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(collection, key, value)
+}
+
+func (l *LocalCache) setLocked(collection string, key string, value []byte) {
+	size := len(key) + len(value)
+	if l.maxBytes > 0 && size > l.maxBytes {
+		return
+	}
+	if elem, ok := l.items[key]; ok {
+		l.removeElement(elem)
+	}
+	elem := l.entries.PushFront(&localEntry{collection, key, value, time.Now().Add(l.ttl)})
+	l.items[key] = elem
+	l.bytes += size
+	for (l.maxEntries > 0 && l.entries.Len() > l.maxEntries) || (l.maxBytes > 0 && l.bytes > l.maxBytes) {
+		l.removeElement(l.entries.Back())
+	}
+}
+
+/** 既に保持している場合のみ値を更新する */
+func (l *LocalCache) update(key string, value []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		l.setLocked(elem.Value.(*localEntry).collection, key, value)
+	}
+}
+
+func (l *LocalCache) remove(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := l.items[key]; ok {
+			l.removeElement(elem)
+		}
+	}
+}
+
+func (l *LocalCache) removeElement(elem *list.Element) {
+	entry := l.entries.Remove(elem).(*localEntry)
+	delete(l.items, entry.key)
+	l.bytes -= len(entry.key) + len(entry.value)
+}
+
+func (l *LocalCache) purge() {
+	l.entries.Init()
+	l.items = map[string]*list.Element{}
+	l.bytes = 0
+}
+
+func (l *LocalCache) purgeCollection(collection string) {
+	for elem := l.entries.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*localEntry).collection == collection {
+			l.removeElement(elem)
+		}
+		elem = next
+	}
+}
+
+func generationKey(collection string) string {
+	return generationCacheKey + "/" + collection
+}
+
+/** 一定間隔でコレクションの世代番号を確認し、他インスタンスで書き込みがあればそのコレクションのキャッシュを破棄する */
+func (l *LocalCache) checkGeneration(ctx context.Context, collection string) {
+	l.mu.Lock()
+	if time.Since(l.checkedAt[collection]) < l.refresh {
+		l.mu.Unlock()
+		return
+	}
+	l.checkedAt[collection] = time.Now()
+	l.mu.Unlock()
+
+	generation, err := memcache.Increment(ctx, generationKey(collection), 0, 0)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if generation != l.generations[collection] {
+		l.purgeCollection(collection)
+		l.generations[collection] = generation
+	}
+}
+
+/** 書き込み時にコレクションの世代番号を進める (自インスタンスの書き込みのみであれば保持しているキャッシュは破棄しない) */
+func (l *LocalCache) bumpGeneration(ctx context.Context, collection string) {
+	generation, err := memcache.Increment(ctx, generationKey(collection), 1, 0)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil || generation != l.generations[collection]+1 {
+		l.purgeCollection(collection)
+	}
+	if err == nil {
+		l.generations[collection] = generation
+	}
+}
@@ -0,0 +1,68 @@
+package foon
+
+import (
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"testing"
+	"time"
+)
+
+func TestLocalCache_件数とサイズで追い出される(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	local := NewLocalCache(2, 0, time.Minute)
+	local.set("Coll", "a", []byte("1"))
+	local.set("Coll", "b", []byte("2"))
+	local.get(ctx, "Coll", "a")
+	local.set("Coll", "c", []byte("3"))
+
+	// 最も使われていないbが追い出される
+	_, ok := local.get(ctx, "Coll", "b")
+	assert.False(t, ok)
+	value, ok := local.get(ctx, "Coll", "a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	assert.Equal(t, 2, local.Len())
+
+	sized := NewLocalCache(0, 10, time.Minute)
+	sized.set("Coll", "a", []byte("1234"))
+	sized.set("Coll", "b", []byte("1234"))
+	assert.Equal(t, 1, sized.Len())
+	sized.set("Coll", "c", []byte("too large value"))
+	_, ok = sized.get(ctx, "Coll", "c")
+	assert.False(t, ok)
+}
+
+func TestLocalCache_世代が変わると破棄される(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	local := NewLocalCache(10, 0, time.Minute)
+	local.SetRefreshInterval(0)
+	local.get(ctx, "Coll", "a")
+	local.set("Coll", "a", []byte("1"))
+
+	// 自インスタンスの書き込みでは破棄されない
+	local.bumpGeneration(ctx, "Coll")
+	_, ok := local.get(ctx, "Coll", "a")
+	assert.True(t, ok)
+
+	// 他インスタンスの書き込み
+	other := NewLocalCache(10, 0, time.Minute)
+	other.bumpGeneration(ctx, "Coll")
+	_, ok = local.get(ctx, "Coll", "a")
+	assert.False(t, ok)
+
+	// 他のコレクションへの書き込みでは破棄されない
+	local.set("Other", "b", []byte("2"))
+	other.bumpGeneration(ctx, "Coll")
+	_, ok = local.get(ctx, "Other", "b")
+	assert.True(t, ok)
+}
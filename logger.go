@@ -2,37 +2,173 @@ package foon
 
 import (
 	"context"
-	"google.golang.org/appengine/log"
 	"fmt"
+	"google.golang.org/appengine/log"
+	"os"
+	"strings"
 )
 
+/** 従来のLogger (SetLoggerで設定するとStructuredLoggerに変換される) */
 type Logger interface {
 	Trace(message string)
 	Warning(message string)
 }
 
+/** ログのレベル */
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+/** ログに付与するキーと値 */
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+/** レベルとフィールドを持つLogger */
+type StructuredLogger interface {
+	Debug(message string, fields ...Field)
+	Info(message string, fields ...Field)
+	Warn(message string, fields ...Field)
+	Error(message string, fields ...Field)
+}
+
+/** 環境変数FOON_TRACEが設定されている場合は既定のLoggerでDebugも出力する */
+const traceEnv = "FOON_TRACE"
+
+/** SetTraceでDebugのログを出力するか切り替えられるLogger */
+type traceableLogger interface {
+	setTrace(enabled bool)
+}
+
+/** AppEngineのログに出力する (level未満のログは出力しない。traceの場合はDebugも出力する) */
 type defaultLogger struct {
-	c context.Context
+	c     context.Context
+	level Level
+	trace bool
 }
 
-func (d defaultLogger) Trace(message string) {
-	//log.Infof(d.c, "%s", message)
+func newDefaultLogger(ctx context.Context) *defaultLogger {
+	return &defaultLogger{ctx, LevelInfo, os.Getenv(traceEnv) != ""}
 }
 
-func (d defaultLogger) Warning(message string) {
-	log.Warningf(d.c, "%s", message)
+func (d *defaultLogger) setTrace(enabled bool) {
+	d.trace = enabled
+}
+
+func (d defaultLogger) Debug(message string, fields ...Field) {
+	if d.level <= LevelDebug || d.trace {
+		log.Debugf(d.c, "%s", formatFields(message, fields))
+	}
+}
+
+func (d defaultLogger) Info(message string, fields ...Field) {
+	if d.level <= LevelInfo {
+		log.Infof(d.c, "%s", formatFields(message, fields))
+	}
+}
+
+func (d defaultLogger) Warn(message string, fields ...Field) {
+	if d.level <= LevelWarn {
+		log.Warningf(d.c, "%s", formatFields(message, fields))
+	}
+}
+
+func (d defaultLogger) Error(message string, fields ...Field) {
+	log.Errorf(d.c, "%s", formatFields(message, fields))
+}
+
+/** 従来のLoggerをStructuredLoggerとして使う (フィールドはメッセージの末尾に付与する。nilの場合は何も出力しない) */
+type legacyLogger struct {
+	logger Logger
+}
+
+func (l legacyLogger) Debug(message string, fields ...Field) {
+	if l.logger != nil {
+		l.logger.Trace(formatFields(message, fields))
+	}
+}
+
+func (l legacyLogger) Info(message string, fields ...Field) {
+	if l.logger != nil {
+		l.logger.Trace(formatFields(message, fields))
+	}
+}
+
+func (l legacyLogger) Warn(message string, fields ...Field) {
+	if l.logger != nil {
+		l.logger.Warning(formatFields(message, fields))
+	}
+}
+
+func (l legacyLogger) Error(message string, fields ...Field) {
+	if l.logger != nil {
+		l.logger.Warning(formatFields(message, fields))
+	}
+}
+
+/** traceableLoggerではないLoggerのDebugのログを切り替える */
+type traceLogger struct {
+	StructuredLogger
+	trace bool
+}
+
+func (t *traceLogger) setTrace(enabled bool) {
+	t.trace = enabled
+}
+
+func (t *traceLogger) Debug(message string, fields ...Field) {
+	if t.trace {
+		t.StructuredLogger.Debug(message, fields...)
+	}
+}
+
+/** "message key=value key=value" の形式にする */
+func formatFields(message string, fields []Field) string {
+	if len(fields) == 0 {
+		return message
+	}
+	builder := strings.Builder{}
+	builder.WriteString(message)
+	for _, field := range fields {
+		builder.WriteString(fmt.Sprintf(" %s=%v", field.Key, field.Value))
+	}
+	return builder.String()
 }
 
-func tracef(logger Logger, format string, args ...interface{}) {
+func tracef(logger StructuredLogger, format string, args ...interface{}) {
 	if logger == nil {
 		return
 	}
-	//logger.Trace(fmt.Sprintf(format, args...))
+	logger.Debug(fmt.Sprintf(format, args...))
 }
 
-func warningf(logger Logger, format string, args ...interface{}) {
+func warningf(logger StructuredLogger, format string, args ...interface{}) {
 	if logger == nil {
 		return
 	}
-	logger.Warning(fmt.Sprintf(format, args...))
+	logger.Warn(fmt.Sprintf(format, args...))
 }
@@ -0,0 +1,127 @@
+package foon
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"sync/atomic"
+)
+
+/** log/slogに出力する */
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func NewSlogLogger(logger *slog.Logger) StructuredLogger {
+	return &slogLogger{logger}
+}
+
+func (s *slogLogger) Debug(message string, fields ...Field) {
+	s.log(slog.LevelDebug, message, fields)
+}
+
+func (s *slogLogger) Info(message string, fields ...Field) {
+	s.log(slog.LevelInfo, message, fields)
+}
+
+func (s *slogLogger) Warn(message string, fields ...Field) {
+	s.log(slog.LevelWarn, message, fields)
+}
+
+func (s *slogLogger) Error(message string, fields ...Field) {
+	s.log(slog.LevelError, message, fields)
+}
+
+func (s *slogLogger) log(level slog.Level, message string, fields []Field) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, field := range fields {
+		attrs = append(attrs, slog.Any(field.Key, field.Value))
+	}
+	s.logger.LogAttrs(ctx, level, message, attrs...)
+}
+
+/** 標準のlogに "[LEVEL] message key=value" の形式で出力する (level未満のログは出力しない。traceの場合はDebugも出力する) */
+type stdLogger struct {
+	logger *log.Logger
+	level  Level
+	trace  bool
+}
+
+func NewStdLogger(logger *log.Logger, level Level) StructuredLogger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogger{logger: logger, level: level}
+}
+
+func (s *stdLogger) setTrace(enabled bool) {
+	s.trace = enabled
+}
+
+func (s *stdLogger) Debug(message string, fields ...Field) {
+	s.log(LevelDebug, message, fields)
+}
+
+func (s *stdLogger) Info(message string, fields ...Field) {
+	s.log(LevelInfo, message, fields)
+}
+
+func (s *stdLogger) Warn(message string, fields ...Field) {
+	s.log(LevelWarn, message, fields)
+}
+
+func (s *stdLogger) Error(message string, fields ...Field) {
+	s.log(LevelError, message, fields)
+}
+
+func (s *stdLogger) log(level Level, message string, fields []Field) {
+	if level < s.level && !(level == LevelDebug && s.trace) {
+		return
+	}
+	s.logger.Printf("[%s] %s", level, formatFields(message, fields))
+}
+
+/**
+ * Debug/Infoのログをevery件に1件だけ出力する (Warn/Errorは全て出力する)
+ * キャッシュのトレースなど件数の多いログを本番で有効にする場合に使う。
+ */
+type sampledLogger struct {
+	logger StructuredLogger
+	every  uint64
+	count  uint64
+}
+
+func NewSampledLogger(logger StructuredLogger, every int) StructuredLogger {
+	if every <= 1 {
+		return logger
+	}
+	return &sampledLogger{logger: logger, every: uint64(every)}
+}
+
+func (s *sampledLogger) sample() bool {
+	return (atomic.AddUint64(&s.count, 1)-1)%s.every == 0
+}
+
+func (s *sampledLogger) Debug(message string, fields ...Field) {
+	if s.sample() {
+		s.logger.Debug(message, fields...)
+	}
+}
+
+func (s *sampledLogger) Info(message string, fields ...Field) {
+	if s.sample() {
+		s.logger.Info(message, fields...)
+	}
+}
+
+func (s *sampledLogger) Warn(message string, fields ...Field) {
+	s.logger.Warn(message, fields...)
+}
+
+func (s *sampledLogger) Error(message string, fields ...Field) {
+	s.logger.Error(message, fields...)
+}
@@ -0,0 +1,92 @@
+package foon
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"log/slog"
+	"testing"
+)
+
+type recordLogger struct {
+	traces   []string
+	warnings []string
+}
+
+func (r *recordLogger) Trace(message string) {
+	r.traces = append(r.traces, message)
+}
+
+func (r *recordLogger) Warning(message string) {
+	r.warnings = append(r.warnings, message)
+}
+
+func TestLogger_標準のlogにレベル以上のログを出力する(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger := NewStdLogger(log.New(buf, "", 0), LevelInfo)
+	logger.Debug("cache is hit", F("path", "foon/users/1"))
+	logger.Info("cache is hit", F("path", "foon/users/1"), F("hit", true))
+	logger.Error("failed")
+
+	assert.Equal(t, "[INFO] cache is hit path=foon/users/1 hit=true\n[ERROR] failed\n", buf.String())
+}
+
+func TestLogger_slogにフィールドを属性として出力する(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	handler := slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	logger := NewSlogLogger(slog.New(handler))
+	logger.Debug("ignored")
+	logger.Warn("failed to get memcache", F("path", "foon/users/1"), F("hit", false))
+
+	output := buf.String()
+	assert.NotContains(t, output, "ignored")
+	assert.Contains(t, output, "level=WARN")
+	assert.Contains(t, output, `msg="failed to get memcache" path=foon/users/1 hit=false`)
+}
+
+func TestLogger_サンプリングはDebugとInfoのみ間引く(t *testing.T) {
+	record := &recordLogger{}
+	logger := NewSampledLogger(legacyLogger{record}, 3)
+	for i := 0; i < 7; i++ {
+		logger.Debug("trace")
+		logger.Warn("warning")
+	}
+
+	assert.Len(t, record.traces, 3)
+	assert.Len(t, record.warnings, 7)
+}
+
+func TestLogger_従来のLoggerにはフィールドをメッセージに付与して渡す(t *testing.T) {
+	record := &recordLogger{}
+	logger := legacyLogger{record}
+	logger.Info("operation finished", F("operation", "get"), F("cache_hit", true))
+	logger.Error("failed", F("reason", "timeout"))
+	legacyLogger{}.Warn("nil logger is ignored")
+
+	assert.Equal(t, []string{"operation finished operation=get cache_hit=true"}, record.traces)
+	assert.Equal(t, []string{"failed reason=timeout"}, record.warnings)
+}
+
+func TestLogger_SetTraceは設定したLoggerを変更しない(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger := NewStdLogger(log.New(buf, "", 0), LevelWarn)
+	s := &Foon{cache: &FirestoreCache{}, logger: logger}
+
+	s.SetTrace(true)
+	assert.Equal(t, logger, s.logger)
+	s.logger.Debug("cache is hit")
+	s.logger.Info("ignored")
+	s.SetTrace(false)
+	s.logger.Debug("ignored")
+	assert.Equal(t, "[DEBUG] cache is hit\n", buf.String())
+
+	record := &recordLogger{}
+	s.SetLogger(record)
+	s.SetTrace(false)
+	s.logger.Debug("ignored")
+	s.logger.Warn("failed")
+	s.SetTrace(true)
+	s.logger.Debug("cache is hit")
+	assert.Equal(t, []string{"cache is hit"}, record.traces)
+	assert.Equal(t, []string{"failed"}, record.warnings)
+}
@@ -0,0 +1,230 @@
+package foon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+/** JSONをデコードした汎用的な値をMessagePackで書き込む */
+func writeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for key, item := range v {
+			if err := writeMsgpack(buf, key); err != nil {
+				return err
+			}
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", value)
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+/** 長さに応じてfix/8/16/32bitのヘッダーを書き込む (code8が0の場合は8bitの形式がない) */
+func writeMsgpackHeader(buf *bytes.Buffer, length int, fix byte, fixMax int, code8 byte, code16 byte, code32 byte) {
+	switch {
+	case length < fixMax:
+		buf.WriteByte(fix | byte(length))
+	case code8 != 0 && length <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(length))
+	}
+}
+
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errMsgpackShort
+	}
+	res := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return res, nil
+}
+
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (r *msgpackReader) read() (interface{}, error) {
+	head, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := head[0]
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return r.str(int(code & 0x1f))
+	case code&0xf0 == 0x90:
+		return r.array(int(code & 0x0f))
+	case code&0xf0 == 0x80:
+		return r.object(int(code & 0x0f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (code - 0xcc))
+		return v, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		v, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - size*8)
+		return int64(v<<shift) >> shift, nil
+	case 0xca:
+		v, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := r.uint(8)
+		return math.Float64frombits(v), err
+	case 0xd9, 0xda, 0xdb:
+		length, err := r.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.str(int(length))
+	case 0xdc, 0xdd:
+		length, err := r.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(int(length))
+	case 0xde, 0xdf:
+		length, err := r.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.object(int(length))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported code 0x%x", code)
+}
+
+func (r *msgpackReader) str(length int) (interface{}, error) {
+	b, err := r.next(length)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) array(length int) (interface{}, error) {
+	if length > len(r.data)-r.pos {
+		return nil, errMsgpackShort
+	}
+	res := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		v, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (r *msgpackReader) object(length int) (interface{}, error) {
+	if length > len(r.data)-r.pos {
+		return nil, errMsgpackShort
+	}
+	res := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key must be string (%T)", key)
+		}
+		v, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		res[name] = v
+	}
+	return res, nil
+}
@@ -0,0 +1,154 @@
+package foon
+
+import (
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+const firestorePackage = "cloud.google.com/go/firestore"
+
+/**
+ * Firestoreに保存された状態に合わせた値を作成する (キャッシュにはこの値を保存する)
+ * - time.Timeはマイクロ秒に切り詰め、UTCにする (モノトニック時計の値も消える)
+ * - firestore:"-" のフィールドは保存されないので空にする (foonのid/parentはKeyから復元されるので残す)
+ * サーバー側で値が決まるフィールド(serverTimestamp)が空の場合や、
+ * マップ・interface{}のどこかにServerTimestamp・ArrayUnionなどの変換の値がある場合は、保存後の値が分からないのでfalseを返す。
+ */
+func normalizeForCache(src interface{}) (interface{}, bool) {
+	value := reflect.ValueOf(src)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return src, true
+	}
+	dst := reflect.New(value.Elem().Type())
+	if !normalizeValue(dst.Elem(), value.Elem()) {
+		return nil, false
+	}
+	return dst.Interface(), true
+}
+
+func normalizeValue(dst reflect.Value, src reflect.Value) bool {
+	if src.Type() == timeType {
+		if src.CanInterface() {
+			t := src.Interface().(time.Time)
+			dst.Set(reflect.ValueOf(t.Truncate(time.Microsecond).UTC()))
+		}
+		return true
+	}
+
+	switch src.Kind() {
+	case reflect.Struct:
+		if src.CanInterface() {
+			dst.Set(src)
+		}
+		types := src.Type()
+		for i := 0; i < types.NumField(); i++ {
+			field := types.Field(i)
+			if !dst.Field(i).CanSet() {
+				continue
+			}
+			tags := strings.Split(field.Tag.Get("firestore"), ",")
+			foonTag := field.Tag.Get("foon")
+			if tags[0] == "-" && foonTag != "id" && foonTag != "parent" {
+				dst.Field(i).Set(reflect.Zero(field.Type))
+				continue
+			}
+			for _, option := range tags[1:] {
+				if option == "serverTimestamp" && src.Field(i).IsZero() {
+					return false
+				}
+			}
+			if !normalizeValue(dst.Field(i), src.Field(i)) {
+				return false
+			}
+		}
+	case reflect.Ptr:
+		if src.IsNil() {
+			return true
+		}
+		elem := reflect.New(src.Type().Elem())
+		if !normalizeValue(elem.Elem(), src.Elem()) {
+			return false
+		}
+		dst.Set(elem)
+	case reflect.Slice:
+		if src.IsNil() {
+			return true
+		}
+		slice := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			if !normalizeValue(slice.Index(i), src.Index(i)) {
+				return false
+			}
+		}
+		dst.Set(slice)
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			if !normalizeValue(dst.Index(i), src.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Interface:
+		if src.IsNil() {
+			return true
+		}
+		inner := src.Elem()
+		if isTransform(inner.Type()) {
+			return false
+		}
+		elem := reflect.New(inner.Type()).Elem()
+		if !normalizeValue(elem, inner) {
+			return false
+		}
+		dst.Set(elem)
+	case reflect.Map:
+		if src.IsNil() {
+			return true
+		}
+		maps := reflect.MakeMapWithSize(src.Type(), src.Len())
+		for _, key := range src.MapKeys() {
+			elem := reflect.New(src.Type().Elem()).Elem()
+			if !normalizeValue(elem, src.MapIndex(key)) {
+				return false
+			}
+			maps.SetMapIndex(key, elem)
+		}
+		dst.Set(maps)
+	default:
+		if src.CanInterface() {
+			dst.Set(src)
+		}
+	}
+	return true
+}
+
+/** Firestoreのサーバー側で変換される値 (ServerTimestamp・Delete・ArrayUnion・ArrayRemoveなど、パッケージ外に公開されていない型) */
+func isTransform(t reflect.Type) bool {
+	if t.PkgPath() != firestorePackage || t.Name() == "" {
+		return false
+	}
+	return unicode.IsLower([]rune(t.Name())[0])
+}
+
+/** 2つのエンティティで値が異なるフィールド名を返す */
+func diffFields(a interface{}, b interface{}) []string {
+	av := reflect.Indirect(reflect.ValueOf(a))
+	bv := reflect.Indirect(reflect.ValueOf(b))
+	if av.Type() != bv.Type() || av.Kind() != reflect.Struct {
+		return []string{"(type)"}
+	}
+	diffs := []string{}
+	types := av.Type()
+	for i := 0; i < types.NumField(); i++ {
+		if types.Field(i).PkgPath != "" {
+			continue
+		}
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			diffs = append(diffs, types.Field(i).Name)
+		}
+	}
+	return diffs
+}
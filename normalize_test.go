@@ -0,0 +1,85 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type normalizeTest struct {
+	ID     string               `foon:"id"`
+	Parent *Key                 `foon:"parent" firestore:"-"`
+	Name   string               `firestore:"name"`
+	Memo   string               `firestore:"-"`
+	Time   time.Time            `firestore:"time"`
+	Times  map[string]time.Time `firestore:"times"`
+}
+
+type interfaceTest struct {
+	ID    string                 `foon:"id"`
+	Value interface{}            `firestore:"value"`
+	Data  map[string]interface{} `firestore:"data"`
+}
+
+type serverTimestampTest struct {
+	ID        string    `foon:"id"`
+	UpdatedAt time.Time `firestore:"updatedAt,serverTimestamp"`
+}
+
+func TestNormalizeForCache_保存される値に合わせる(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 123456789, time.Local)
+	src := &normalizeTest{
+		ID:     "id001",
+		Parent: &Key{Collection: "Parent", ID: "p001"},
+		Name:   "name",
+		Memo:   "not stored",
+		Time:   now,
+		Times:  map[string]time.Time{"a": now},
+	}
+
+	res, ok := normalizeForCache(src)
+	assert.True(t, ok)
+	normalized := res.(*normalizeTest)
+
+	assert.Equal(t, "id001", normalized.ID)
+	assert.Equal(t, "p001", normalized.Parent.ID)
+	assert.Equal(t, "name", normalized.Name)
+	assert.Equal(t, "", normalized.Memo)
+	assert.Equal(t, 123456000, normalized.Time.Nanosecond())
+	assert.Equal(t, time.UTC, normalized.Time.Location())
+	assert.Equal(t, 123456000, normalized.Times["a"].Nanosecond())
+
+	// 元の値は変更しない
+	assert.Equal(t, "not stored", src.Memo)
+	assert.Equal(t, 123456789, src.Time.Nanosecond())
+}
+
+func TestNormalizeForCache_サーバーで値が決まる場合はキャッシュしない(t *testing.T) {
+	_, ok := normalizeForCache(&serverTimestampTest{ID: "id001"})
+	assert.False(t, ok)
+
+	_, ok = normalizeForCache(&serverTimestampTest{ID: "id001", UpdatedAt: time.Now()})
+	assert.True(t, ok)
+}
+
+func TestNormalizeForCache_マップやinterfaceの中の変換の値もキャッシュしない(t *testing.T) {
+	_, ok := normalizeForCache(&interfaceTest{ID: "id001", Value: firestore.ServerTimestamp})
+	assert.False(t, ok)
+
+	_, ok = normalizeForCache(&interfaceTest{ID: "id001", Data: map[string]interface{}{"tags": firestore.ArrayUnion("a")}})
+	assert.False(t, ok)
+
+	_, ok = normalizeForCache(&interfaceTest{ID: "id001", Data: map[string]interface{}{"nested": []interface{}{firestore.Delete}}})
+	assert.False(t, ok)
+}
+
+func TestNormalizeForCache_interfaceの中の時刻も切り詰める(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 123456789, time.Local)
+	res, ok := normalizeForCache(&interfaceTest{ID: "id001", Value: now, Data: map[string]interface{}{"at": now}})
+	assert.True(t, ok)
+	normalized := res.(*interfaceTest)
+	assert.Equal(t, 123456000, normalized.Value.(time.Time).Nanosecond())
+	assert.Equal(t, time.UTC, normalized.Value.(time.Time).Location())
+	assert.Equal(t, 123456000, normalized.Data["at"].(time.Time).Nanosecond())
+}
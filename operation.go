@@ -0,0 +1,147 @@
+package foon
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+/** Operationの種類 */
+type OperationKind int
+
+const (
+	GetOperation OperationKind = iota
+	PutOperation
+	InsertOperation
+	DeleteOperation
+	QueryOperation
+	BatchOperation
+	TransactionOperation
+)
+
+func (k OperationKind) String() string {
+	switch k {
+	case GetOperation:
+		return "get"
+	case PutOperation:
+		return "put"
+	case InsertOperation:
+		return "insert"
+	case DeleteOperation:
+		return "delete"
+	case QueryOperation:
+		return "query"
+	case BatchOperation:
+		return "batch"
+	case TransactionOperation:
+		return "transaction"
+	}
+	return "unknown"
+}
+
+/** Interceptorに渡される操作の内容 */
+type Operation struct {
+	Kind OperationKind
+	// 対象のKey (Queryの場合は親のKey、Insertの場合は実行後にIDが設定される)
+	Keys       []*Key
+	Conditions *Conditions
+	// 結果を全てキャッシュから取得した場合はtrue (実行後に設定される)
+	FromCache bool
+	// 取得したドキュメントの数 (実行後に設定される)
+	Documents int
+	// 読み込み先 (Documentsを数えるために使う)
+	dst interface{}
+}
+
+type Handler func(ctx context.Context, op *Operation) error
+
+/**
+ * 全ての操作の前後に処理を挟む
+ * nextに渡したContextはFirestoreへのリクエストに使われる。
+ */
+type Interceptor func(ctx context.Context, op *Operation, next Handler) error
+
+/** Interceptorを追加する (先に追加したものほど外側で実行される) */
+func (s *Foon) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+/** 統計などのラベルに使うコレクション名 */
+func (op *Operation) collection() string {
+	if len(op.Keys) == 0 {
+		return ""
+	}
+	return op.Keys[0].Collection
+}
+
+/** Interceptorを順に通してfnを実行する */
+func (s *Foon) intercept(op *Operation, fn func(s *Foon) error) (err error) {
+	if err := s.checkBudget(); err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		s.cache.metrics.observe(op.collection(), op.Kind.String(), start)
+		elapsed := time.Since(start)
+		s.logOperation(op, elapsed, err)
+		s.finishOperation(op, elapsed)
+	}()
+	return runInterceptors(s.Context, s.interceptors, op, func(ctx context.Context, op *Operation) error {
+		// 同じFoonを並行して使えるように、コンテキストと実行中の操作はコピーに設定して実行する
+		f := *s
+		f.Context, f.current = ctx, op
+		if client, ok := s.client.(*FirestoreClientImpl); ok {
+			f.client = &FirestoreClientImpl{ctx, client.client}
+		}
+		if err := fn(&f); err != nil {
+			return err
+		}
+		op.Documents = countDocuments(op.dst)
+		return nil
+	})
+}
+
+/** スライスの場合は要素数、それ以外は1を返す (nilの場合は0) */
+func countDocuments(dst interface{}) int {
+	if dst == nil {
+		return 0
+	}
+	value := reflect.Indirect(reflect.ValueOf(dst))
+	if value.Kind() == reflect.Slice {
+		return value.Len()
+	}
+	return 1
+}
+
+func runInterceptors(ctx context.Context, interceptors []Interceptor, op *Operation, last Handler) error {
+	handler := last
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, op *Operation) error {
+			return interceptor(ctx, op, next)
+		}
+	}
+	return handler(ctx, op)
+}
+
+func (s *Foon) logOperation(op *Operation, duration time.Duration, err error) {
+	if s.logger == nil {
+		return
+	}
+	fields := []Field{F("operation", op.Kind.String()), F("cache_hit", op.FromCache), F("duration", duration)}
+	if len(op.Keys) > 0 {
+		fields = append(fields, F("path", op.Keys[0].Path()), F("keys", len(op.Keys)))
+	}
+	if err != nil && NoSuchDocument.IsNot(err) {
+		s.logger.Warn("operation failed", append(fields, F("reason", err))...)
+		return
+	}
+	s.logger.Debug("operation finished", fields...)
+}
+
+/** 実行中の操作の結果がキャッシュから取得されたことを記録する */
+func (s *Foon) servedFromCache() {
+	if s.current != nil {
+		s.current.FromCache = true
+	}
+}
@@ -0,0 +1,109 @@
+package foon
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+type interceptorKey struct{}
+
+func TestFoon_Interceptorは追加した順に外側から実行される(t *testing.T) {
+	s := &Foon{Context: context.Background(), cache: &FirestoreCache{}}
+	calls := []string{}
+	s.Use(func(ctx context.Context, op *Operation, next Handler) error {
+		calls = append(calls, "first:"+op.Kind.String())
+		err := next(context.WithValue(ctx, interceptorKey{}, "traced"), op)
+		calls = append(calls, "first:done")
+		return err
+	}, func(ctx context.Context, op *Operation, next Handler) error {
+		calls = append(calls, "second:"+ctx.Value(interceptorKey{}).(string))
+		err := next(ctx, op)
+		assert.True(t, op.FromCache)
+		return err
+	})
+
+	op := &Operation{Kind: GetOperation, Keys: []*Key{{Collection: "users", ID: "1"}}}
+	err := s.intercept(op, func(s *Foon) error {
+		// nextに渡したContextで実行される
+		calls = append(calls, "run:"+s.Context.Value(interceptorKey{}).(string))
+		s.servedFromCache()
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first:get", "second:traced", "run:traced", "first:done"}, calls)
+	assert.Nil(t, s.Context.Value(interceptorKey{}))
+	assert.Nil(t, s.current)
+}
+
+func TestFoon_Interceptorで操作を中断できる(t *testing.T) {
+	s := &Foon{Context: context.Background(), cache: &FirestoreCache{}}
+	denied := errors.New("denied")
+	s.Use(func(ctx context.Context, op *Operation, next Handler) error {
+		if op.Kind == DeleteOperation {
+			return denied
+		}
+		return next(ctx, op)
+	})
+
+	executed := false
+	err := s.intercept(&Operation{Kind: DeleteOperation}, func(s *Foon) error {
+		executed = true
+		return nil
+	})
+	assert.Equal(t, denied, err)
+	assert.False(t, executed)
+
+	err = s.intercept(&Operation{Kind: QueryOperation}, func(s *Foon) error {
+		executed = true
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, executed)
+}
+
+func TestFoon_実行中も共有しているFoonのContextは変更しない(t *testing.T) {
+	store := &Foon{Context: context.Background(), cache: &FirestoreCache{}}
+	store.Use(func(ctx context.Context, op *Operation, next Handler) error {
+		return next(context.WithValue(ctx, interceptorKey{}, "traced"), op)
+	})
+
+	err := store.intercept(&Operation{Kind: GetOperation}, func(s *Foon) error {
+		assert.Equal(t, "traced", s.Context.Value(interceptorKey{}))
+		assert.Nil(t, store.Context.Value(interceptorKey{}))
+		assert.Nil(t, store.current)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestFoon_Interceptorで渡したContextをFirestoreへのリクエストに使う(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	server.addUser("user001", "foo", 20)
+	s := newFakeStore(t, server)
+	cancel := false
+	s.Use(func(ctx context.Context, op *Operation, next Handler) error {
+		if !cancel {
+			return next(ctx, op)
+		}
+		canceled, stop := context.WithCancel(ctx)
+		stop()
+		return next(canceled, op)
+	})
+
+	users := []*TestUser{{UserID: "user001"}}
+	assert.NoError(t, s.GetMulti(&users))
+	assert.Equal(t, "foo", users[0].UserName)
+
+	cancel = true
+	users = []*TestUser{{UserID: "user001"}}
+	assert.Equal(t, codes.Canceled, status.Code(s.GetMulti(&users)))
+	assert.Equal(t, codes.Canceled, status.Code(s.Delete(&TestUser{UserID: "user001"})))
+	assert.Equal(t, codes.Canceled, status.Code(s.RunInTransaction(func(f *Foon) error {
+		return nil
+	})))
+}
@@ -0,0 +1,80 @@
+package foon
+
+import (
+	"reflect"
+)
+
+func (w *Conditions) WhereEq(column string, value interface{}) *Conditions {
+	return w.Where(column, "==", value)
+}
+
+func (w *Conditions) WhereNotEq(column string, value interface{}) *Conditions {
+	return w.Where(column, "!=", value)
+}
+
+func (w *Conditions) WhereLt(column string, value interface{}) *Conditions {
+	return w.Where(column, "<", value)
+}
+
+func (w *Conditions) WhereLte(column string, value interface{}) *Conditions {
+	return w.Where(column, "<=", value)
+}
+
+func (w *Conditions) WhereGt(column string, value interface{}) *Conditions {
+	return w.Where(column, ">", value)
+}
+
+func (w *Conditions) WhereGte(column string, value interface{}) *Conditions {
+	return w.Where(column, ">=", value)
+}
+
+/** start以上end未満 */
+func (w *Conditions) WhereRange(column string, start interface{}, end interface{}) *Conditions {
+	return w.Where(column, ">=", start).Where(column, "<", end)
+}
+
+/** valuesのいずれかと一致する (valuesはスライス。件数が多い場合はクエリを分けて実行する) */
+func (w *Conditions) WhereIn(column string, values interface{}) *Conditions {
+	return w.Where(column, "in", values)
+}
+
+func (w *Conditions) WhereNotIn(column string, values interface{}) *Conditions {
+	return w.Where(column, "not-in", values)
+}
+
+func (w *Conditions) WhereArrayContains(column string, value interface{}) *Conditions {
+	return w.Where(column, "array-contains", value)
+}
+
+func (w *Conditions) WhereArrayContainsAny(column string, values interface{}) *Conditions {
+	return w.Where(column, "array-contains-any", values)
+}
+
+func (w Where) isInequality() bool {
+	switch w.Operation {
+	case "<", "<=", ">", ">=", "!=", "not-in":
+		return true
+	}
+	return false
+}
+
+func (w Where) isList() bool {
+	switch w.Operation {
+	case "in", "not-in", "array-contains-any":
+		return true
+	}
+	return false
+}
+
+/** valueがスライスの場合は要素を返す */
+func (w Where) values() ([]interface{}, bool) {
+	value := reflect.ValueOf(w.Value)
+	if !value.IsValid() || (value.Kind() != reflect.Slice && value.Kind() != reflect.Array) {
+		return nil, false
+	}
+	values := []interface{}{}
+	for i := 0; i < value.Len(); i++ {
+		values = append(values, value.Index(i).Interface())
+	}
+	return values, true
+}
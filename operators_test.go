@@ -0,0 +1,127 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"os"
+	"testing"
+)
+
+func TestOperators_演算子と値の組み合わせを検証する(t *testing.T) {
+	valid := []*Conditions{
+		NewConditions().WhereEq("name", "a").WhereIn("num", []int{1, 2}),
+		NewConditions().WhereRange("num", 1, 10).OrderBy("num", firestore.Asc).OrderBy("name", firestore.Desc),
+		NewConditions().WhereNotIn("num", []int{3, 1, 2}),
+		NewConditions().WhereNotEq("name", "a").WhereArrayContains("tags", "x"),
+		NewConditions().WhereArrayContainsAny("tags", []string{"x", "y"}).WhereGt("num", 1),
+	}
+	for _, c := range valid {
+		assert.NoError(t, c.Validate(), c.String())
+	}
+
+	invalid := []*Conditions{
+		NewConditions().Where("num", "=", 1),
+		NewConditions().WhereIn("num", 1),
+		NewConditions().WhereIn("num", []int{}),
+		NewConditions().WhereIn("num", []int{1}).WhereArrayContainsAny("tags", []string{"x"}),
+		NewConditions().WhereArrayContains("tags", "x").WhereArrayContainsAny("tags", []string{"y"}),
+		NewConditions().WhereNotEq("num", 1).WhereNotIn("name", []string{"a"}),
+		NewConditions().WhereNotEq("num", nil),
+		NewConditions().WhereNotIn("num", []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}),
+		NewConditions().WhereNotIn("num", []interface{}{1, "a"}),
+		NewConditions().WhereGt("num", 1).WhereLt("name", "a"),
+		NewConditions().WhereGt("num", 1).OrderBy("name", firestore.Asc),
+	}
+	for _, c := range invalid {
+		err := c.Validate()
+		assert.True(t, errors.Is(err, ErrInvalidQuery), c.String())
+	}
+}
+
+func TestOperators_inなどはクエリを分けて実行する(t *testing.T) {
+	plan := NewConditions().WhereEq("name", "a").Where("num", "in", []int{1, 2, 3}).plan()
+	assert.Equal(t, 3, len(plan.queries))
+	assert.Equal(t, Queries{Where{"name", "==", "a"}, Where{"num", "==", 2}}, plan.queries[1].Queries)
+
+	plan = NewConditions().WhereNotIn("num", []int{5, 1}).OrderBy("num", firestore.Desc).Offset(2).Limit(3).plan()
+	assert.Equal(t, 3, len(plan.queries))
+	assert.Equal(t, Queries{Where{"num", "<", 1}, Order{"num", firestore.Desc}, Limit(5)}, plan.queries[0].Queries)
+	assert.Equal(t, Queries{Where{"num", ">", 1}, Where{"num", "<", 5}, Order{"num", firestore.Desc}, Limit(5)}, plan.queries[1].Queries)
+	assert.Equal(t, Queries{Where{"num", ">", 5}, Order{"num", firestore.Desc}, Limit(5)}, plan.queries[2].Queries)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}}, plan.orders)
+	assert.Equal(t, 2, plan.offset)
+	assert.Equal(t, 3, plan.limit)
+
+	plan = NewConditions().WhereNotEq("num", 1).WhereArrayContainsAny("tags", []string{"x", "y"}).plan()
+	assert.Equal(t, 4, len(plan.queries))
+	assert.Equal(t, []CursorOrder{{"num", firestore.Asc}}, plan.orders)
+
+	// 分ける必要がなければそのまま実行する
+	base := NewConditions().WhereEq("name", "a").Limit(3)
+	plan = base.plan()
+	assert.Equal(t, 1, len(plan.queries))
+	assert.Equal(t, base.Hash(), plan.queries[0].Hash())
+}
+
+func TestOperators_inの結果をまとめて取得できる(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8915")
+	store, err := NewStoreWithProjectID(ctx, "everychart-dev")
+
+	datas := []*CursorTest{}
+	for i := 0; i < 8; i++ {
+		datas = append(datas, &CursorTest{
+			ID:   fmt.Sprintf("operator%03d", i),
+			Name: "operator",
+			Num:  i,
+		})
+	}
+	if err := store.PutMulti(&datas); err != nil {
+		t.Errorf("failed to put data (reason: %v)", err)
+	}
+
+	results := []*CursorTest{}
+	cond := NewConditions().WhereEq("name", "operator").WhereIn("num", []int{6, 1, 3, 1}).OrderBy("num", firestore.Desc).Limit(2)
+	if err := store.GetByQueryWithoutCache(NewKey(&CursorTest{}), &results, cond); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, 6, results[0].Num)
+	assert.Equal(t, 3, results[1].Num)
+
+	results = []*CursorTest{}
+	cond = NewConditions().WhereEq("name", "operator").WhereNotIn("num", []int{2, 5}).WhereLt("num", 7)
+	if err := store.GetByQueryWithoutCache(NewKey(&CursorTest{}), &results, cond); err != nil {
+		t.Fatal(err)
+	}
+	nums := []int{}
+	for _, result := range results {
+		nums = append(nums, result.Num)
+	}
+	assert.Equal(t, []int{0, 1, 3, 4, 6}, nums)
+}
+
+func TestOperators_Firestoreの上限を超えるinもまとめて取得できる(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	server.addUser("user001", "foo", 20)
+	server.addUser("user002", "bar", 30)
+	s := newFakeStore(t, server)
+
+	names := []string{}
+	for i := 0; i < 31; i++ {
+		names = append(names, fmt.Sprintf("name%02d", i))
+	}
+	users := []TestUser{}
+	assert.NoError(t, s.GetByQueryWithoutCache(&Key{Collection: "TestUser"}, &users, NewConditions().WhereIn("userName", names)))
+
+	// 値毎にクエリを実行し、重複を除いてまとめる
+	assert.Len(t, server.requests, 31)
+	assert.Len(t, users, 2)
+}
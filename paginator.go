@@ -0,0 +1,136 @@
+package foon
+
+import (
+	"reflect"
+)
+
+/** Paginatorで取得したページ */
+type Page struct {
+	// 取得したエンティティのスライス (srcと同じ型)
+	Items      interface{}
+	NextCursor string
+	PrevCursor string
+	HasNext    bool
+	HasPrev    bool
+}
+
+/**
+ * 前後のページを辿るためのPaginator
+ * 件数+1件を取得して次のページの有無を判定し、前のページは並び順を逆にしたクエリで取得する。
+ * 各ページはGetByQueryと同じクエリのキャッシュを使う。
+ */
+type Paginator struct {
+	foon       *Foon
+	key        *Key
+	conditions *Conditions
+	size       int
+}
+
+/** conditionsのLimitは無視してsize件ずつ取得する (OrderByがない場合は不等号のフィールドかドキュメントIDの順) */
+func (s *Foon) NewPaginator(key *Key, conditions *Conditions, size int) (*Paginator, error) {
+	if size <= 0 {
+		return nil, ErrInvalidPageSize
+	}
+	if conditions == nil {
+		conditions = NewConditions()
+	}
+	return &Paginator{s, key, conditions, size}, nil
+}
+
+func (p *Paginator) First(src interface{}) (*Page, error) {
+	return p.fetch(src, nil, false)
+}
+
+func (p *Paginator) Last(src interface{}) (*Page, error) {
+	return p.fetch(src, nil, true)
+}
+
+/** NextCursorの次のページを取得する */
+func (p *Paginator) Next(src interface{}, cursor string) (*Page, error) {
+	anchor, err := p.parse(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return p.fetch(src, anchor, false)
+}
+
+/** PrevCursorの前のページを取得する */
+func (p *Paginator) Prev(src interface{}, cursor string) (*Page, error) {
+	anchor, err := p.parse(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return p.fetch(src, anchor, true)
+}
+
+func (p *Paginator) parse(token string) (*Cursor, error) {
+	cursor, err := p.foon.ParseCursor(token)
+	if err != nil {
+		return nil, err
+	}
+	if cursor == nil || cursor.Path == "" || cursor.Fingerprint == "" {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Fingerprint != p.conditions.fingerprint(p.key) {
+		return nil, ErrCursorMismatch
+	}
+	return cursor, nil
+}
+
+func (p *Paginator) fetch(src interface{}, anchor *Cursor, reverse bool) (*Page, error) {
+	if err := p.foon.validSlice(src); err != nil {
+		return nil, err
+	}
+	conditions := p.conditions.page(p.size+1, reverse)
+	if anchor != nil {
+		start := *anchor
+		start.Orders = conditions.cursor.Orders
+		conditions = conditions.StartAfter(&start)
+	}
+	if err := p.foon.GetByQuery(p.key, src, conditions); err != nil {
+		return nil, err
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(src))
+	more := value.Len() > p.size
+	if more {
+		value.Set(value.Slice(0, p.size))
+	}
+	page := &Page{HasNext: more, HasPrev: anchor != nil}
+	if reverse {
+		swap := reflect.Swapper(value.Interface())
+		for i, j := 0, value.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+		page.HasNext, page.HasPrev = anchor != nil, more
+	}
+
+	if value.Len() > 0 {
+		if page.HasPrev {
+			page.PrevCursor = p.cursor(value.Index(0))
+		}
+		if page.HasNext {
+			page.NextCursor = p.cursor(value.Index(value.Len() - 1))
+		}
+	}
+	page.Items = value.Interface()
+	return page, nil
+}
+
+/** エンティティの位置を表すカーソル (並び順は常に順方向のものを使う) */
+func (p *Paginator) cursor(elem reflect.Value) string {
+	if elem.Kind() != reflect.Ptr {
+		elem = elem.Addr()
+	}
+	key, err := KeyError(elem.Interface())
+	if err != nil {
+		p.foon.warningf("failed to create page cursor (reason: %v)", err)
+		return ""
+	}
+	cursor := p.conditions.page(p.size+1, false).cursor.NewCursorWithOrders()
+	cursor.ID = key.ID
+	cursor.Path = key.Path()
+	cursor.setEntityValues(elem.Interface())
+	cursor.Fingerprint = p.conditions.fingerprint(p.key)
+	return p.foon.encodeCursor(cursor)
+}
@@ -0,0 +1,182 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"os"
+	"testing"
+)
+
+func TestPaginator_ページの条件を作成できる(t *testing.T) {
+	conditions := NewConditions().Where("num", ">", 1).OrderBy("num", firestore.Desc).Limit(100)
+
+	forward := conditions.page(6, false)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}}, forward.cursor.Orders)
+	assert.Equal(t, 6, forward.limit)
+	assert.Contains(t, forward.Queries, Query(Limit(6)))
+	assert.NotContains(t, forward.Queries, Query(Limit(100)))
+
+	backward := conditions.page(6, true)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Asc}}, backward.cursor.Orders)
+	assert.Equal(t, conditions.fingerprint(&Key{Collection: "CursorTest"}), backward.fingerprint(&Key{Collection: "CursorTest"}))
+
+	// OrderByがない場合はドキュメントIDの順
+	assert.Equal(t, []CursorOrder{{firestore.DocumentID, firestore.Desc}}, NewConditions().page(6, true).cursor.Orders)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}}, NewConditions().WhereGt("num", 1).page(6, true).cursor.Orders)
+	assert.NoError(t, NewConditions().WhereGt("num", 1).page(6, false).Validate())
+}
+
+func TestPaginator_前後のページを取得できる(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8915")
+	store, err := NewStoreWithProjectID(ctx, "everychart-dev")
+
+	datas := []*CursorTest{}
+	for i := 0; i < 7; i++ {
+		datas = append(datas, &CursorTest{
+			ID:   fmt.Sprintf("page%03d", i),
+			Name: "page",
+			Num:  i,
+		})
+	}
+	if err := store.PutMulti(&datas); err != nil {
+		t.Errorf("failed to put data (reason: %v)", err)
+	}
+
+	paginator, err := store.NewPaginator(NewKey(&CursorTest{}), NewConditions().Where("name", "==", "page").OrderBy("num", firestore.Asc), 3)
+	assert.NoError(t, err)
+	results := []*CursorTest{}
+	first, err := paginator.First(&results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, 0, results[0].Num)
+	assert.True(t, first.HasNext)
+	assert.False(t, first.HasPrev)
+
+	results = []*CursorTest{}
+	second, err := paginator.Next(&results, first.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []int{3, 4, 5}, []int{results[0].Num, results[1].Num, results[2].Num})
+	assert.True(t, second.HasNext)
+	assert.True(t, second.HasPrev)
+
+	results = []*CursorTest{}
+	last, err := paginator.Next(&results, second.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(results))
+	assert.False(t, last.HasNext)
+
+	results = []*CursorTest{}
+	prev, err := paginator.Prev(&results, second.PrevCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []int{0, 1, 2}, []int{results[0].Num, results[1].Num, results[2].Num})
+	assert.False(t, prev.HasPrev)
+	assert.True(t, prev.HasNext)
+
+	// 別の条件のカーソルは使えない
+	other, err := store.NewPaginator(NewKey(&CursorTest{}), NewConditions().Where("name", "==", "other").OrderBy("num", firestore.Asc), 3)
+	assert.NoError(t, err)
+	_, err = other.Next(&results, first.NextCursor)
+	assert.Equal(t, ErrCursorMismatch, err)
+}
+
+func TestPaginator_Fingerprintのないカーソルは使えない(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	s := newFakeStore(t, server)
+	s.SetKeyProvider(NewStaticKeyProvider("key1", []byte("0123456789abcdef0123456789abcdef")))
+	paginator, err := s.NewPaginator(&Key{Collection: "TestUser"}, NewConditions().OrderBy("age", firestore.Asc), 3)
+	assert.NoError(t, err)
+
+	// 鍵で暗号化されていてもFingerprintがなければ拒否する
+	forged := newCursor()
+	forged.AddField("age", firestore.Asc)
+	forged.ID = "user000"
+	forged.Path = "TestUser/user000"
+	forged.Values = []FieldValue{{Kind: IntKind, Int: 10}}
+	token := s.encodeCursor(forged)
+	assert.NotEmpty(t, token)
+
+	users := []TestUser{}
+	_, err = paginator.Next(&users, token)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = paginator.Prev(&users, forged.String())
+	assert.Error(t, err)
+	assert.Empty(t, server.requests)
+}
+
+func TestPaginator_件数が1未満の場合はエラー(t *testing.T) {
+	s := &Foon{}
+	for _, size := range []int{0, -1} {
+		paginator, err := s.NewPaginator(&Key{Collection: "TestUser"}, nil, size)
+		assert.Nil(t, paginator)
+		assert.Equal(t, ErrInvalidPageSize, err)
+	}
+	paginator, err := s.NewPaginator(&Key{Collection: "TestUser"}, nil, 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, paginator.conditions)
+}
+
+func TestPaginator_開始と終了の位置を引き継ぐ(t *testing.T) {
+	conditions := NewConditions().OrderBy("num", firestore.Asc).StartAtValues(3).EndBeforeValues(6)
+
+	forward := conditions.page(11, false)
+	assert.Equal(t, &StartAt{cursorBound{Values: []interface{}{3}}}, forward.cursorQuery)
+	assert.Equal(t, &EndBefore{cursorBound{Values: []interface{}{6}}}, forward.endQuery)
+
+	// 並び順を逆にする場合は開始・終了位置を入れ替える
+	backward := conditions.page(11, true)
+	assert.Equal(t, &StartAfter{cursorBound{Values: []interface{}{6}}}, backward.cursorQuery)
+	assert.Equal(t, &EndAt{cursorBound{Values: []interface{}{3}}}, backward.endQuery)
+
+	cursor := newTestCursor()
+	cursor.Values = []FieldValue{{Kind: IntKind, Int: 3}}
+	backward = NewConditions().StartAt(cursor).page(11, true)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Asc}}, backward.endQuery.(*EndAt).Cursor.Orders)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Desc}}, cursor.Orders)
+	assert.Equal(t, []CursorOrder{{"num", firestore.Asc}}, backward.cursor.Orders)
+}
+
+func TestPaginator_次のページでも終了位置を使う(t *testing.T) {
+	server := &fakeFirestoreServer{}
+	server.addUser("user001", "foo", 20)
+	server.addUser("user002", "bar", 30)
+	s := newFakeStore(t, server)
+	paginator, err := s.NewPaginator(&Key{Collection: "TestUser"}, NewConditions().OrderBy("age", firestore.Asc).StartAtValues(10).EndAtValues(40), 1)
+	assert.NoError(t, err)
+
+	users := []TestUser{}
+	first, err := paginator.First(&users)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, first.NextCursor)
+	query := server.requests[0].GetStructuredQuery()
+	assert.Equal(t, int64(10), query.GetStartAt().GetValues()[0].GetIntegerValue())
+	assert.Equal(t, int64(40), query.GetEndAt().GetValues()[0].GetIntegerValue())
+
+	users = []TestUser{}
+	_, err = paginator.Next(&users, first.NextCursor)
+	assert.NoError(t, err)
+	query = server.requests[1].GetStructuredQuery()
+	assert.Equal(t, int64(20), query.GetStartAt().GetValues()[0].GetIntegerValue())
+	assert.Equal(t, int64(40), query.GetEndAt().GetValues()[0].GetIntegerValue())
+
+	users = []TestUser{}
+	_, err = paginator.Prev(&users, first.NextCursor)
+	assert.NoError(t, err)
+	query = server.requests[2].GetStructuredQuery()
+	assert.Equal(t, int64(20), query.GetStartAt().GetValues()[0].GetIntegerValue())
+	assert.Equal(t, int64(10), query.GetEndAt().GetValues()[0].GetIntegerValue())
+}
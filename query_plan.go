@@ -0,0 +1,174 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"sort"
+	"strings"
+)
+
+/**
+ * 条件の実行計画
+ * in・array-contains-anyは値毎に==・array-contains、!=・not-inは範囲のクエリに分けて実行する。
+ * (構造体のフィールドは型が1つなので、範囲のクエリの和は!=・not-inと同じ結果になる)
+ * 分けた場合は結果をまとめて重複を除き、並び順・Offset・Limitを適用する。
+ */
+type queryPlan struct {
+	queries []*Conditions
+	orders  []CursorOrder
+	offset  int
+	limit   int
+}
+
+func (c Conditions) plan() *queryPlan {
+	alternatives := [][]Query{{}}
+	offset, limit := 0, 0
+	split := false
+	for _, q := range c.Queries {
+		switch query := q.(type) {
+		case Offset:
+			offset = int(query)
+			continue
+		case Limit:
+			limit = int(query)
+			continue
+		case Where:
+			if options := query.alternatives(); options != nil {
+				split = true
+				product := [][]Query{}
+				for _, alternative := range alternatives {
+					for _, option := range options {
+						product = append(product, append(append([]Query{}, alternative...), option...))
+					}
+				}
+				alternatives = product
+				continue
+			}
+		}
+		for i := range alternatives {
+			alternatives[i] = append(alternatives[i], q)
+		}
+	}
+	if !split {
+		return &queryPlan{queries: []*Conditions{&c}}
+	}
+
+	plan := &queryPlan{orders: c.effectiveOrders(), offset: offset, limit: limit}
+	for _, queries := range alternatives {
+		sub := c.Clone()
+		sub.Queries = queries
+		if limit > 0 {
+			// Offsetはまとめた後に適用する
+			sub = sub.Limit(offset + limit)
+		}
+		plan.queries = append(plan.queries, sub)
+	}
+	return plan
+}
+
+/** 分けて実行するクエリの条件 (分ける必要がない場合はnil) */
+func (w Where) alternatives() [][]Query {
+	values, _ := w.values()
+	options := [][]Query{}
+	switch w.Operation {
+	case "in":
+		for _, value := range values {
+			options = append(options, []Query{Where{w.Column, "==", value}})
+		}
+	case "array-contains-any":
+		for _, value := range values {
+			options = append(options, []Query{Where{w.Column, "array-contains", value}})
+		}
+	case "!=":
+		options = append(options, []Query{Where{w.Column, "<", w.Value}}, []Query{Where{w.Column, ">", w.Value}})
+	case "not-in":
+		sort.SliceStable(values, func(i, j int) bool {
+			cmp, _ := newFieldValue(values[i]).compare(newFieldValue(values[j]))
+			return cmp < 0
+		})
+		options = append(options, []Query{Where{w.Column, "<", values[0]}})
+		for i := 1; i < len(values); i++ {
+			options = append(options, []Query{Where{w.Column, ">", values[i-1]}, Where{w.Column, "<", values[i]}})
+		}
+		options = append(options, []Query{Where{w.Column, ">", values[len(values)-1]}})
+	default:
+		return nil
+	}
+	return options
+}
+
+/** 実行時の並び順 (OrderByがなく不等号の条件がある場合はそのフィールドの昇順になる) */
+func (c Conditions) effectiveOrders() []CursorOrder {
+	if c.hasOrder() {
+		orders := []CursorOrder{}
+		for _, q := range c.Queries {
+			if order, ok := q.(Order); ok {
+				orders = append(orders, CursorOrder{order.Column, order.Direction})
+			}
+		}
+		return orders
+	}
+	if cursor := c.documentCursor(); cursor != nil {
+		return cursor.Orders
+	}
+	for _, q := range c.Queries {
+		if where, ok := q.(Where); ok && where.isInequality() {
+			return []CursorOrder{{where.Column, firestore.Asc}}
+		}
+	}
+	return nil
+}
+
+/** 分けて実行した結果をまとめる */
+func (p *queryPlan) merge(docs []*firestore.DocumentSnapshot) []*firestore.DocumentSnapshot {
+	if len(p.queries) <= 1 {
+		return docs
+	}
+	seen := map[string]bool{}
+	unique := []*firestore.DocumentSnapshot{}
+	for _, doc := range docs {
+		if seen[doc.Ref.Path] {
+			continue
+		}
+		seen[doc.Ref.Path] = true
+		unique = append(unique, doc)
+	}
+	sort.SliceStable(unique, func(i, j int) bool {
+		return p.compare(unique[i], unique[j]) < 0
+	})
+
+	if p.offset >= len(unique) {
+		return []*firestore.DocumentSnapshot{}
+	}
+	unique = unique[p.offset:]
+	if p.limit > 0 && len(unique) > p.limit {
+		unique = unique[:p.limit]
+	}
+	return unique
+}
+
+/** Firestoreと同じく並び順のフィールドで比較し、同じ場合はドキュメントのパスで比較する */
+func (p *queryPlan) compare(a, b *firestore.DocumentSnapshot) int {
+	direction := firestore.Asc
+	for _, order := range p.orders {
+		direction = order.Direction
+		cmp := 0
+		if order.FieldName == firestore.DocumentID {
+			cmp = strings.Compare(a.Ref.Path, b.Ref.Path)
+		} else {
+			av, _ := a.DataAt(order.FieldName)
+			bv, _ := b.DataAt(order.FieldName)
+			cmp, _ = newFieldValue(av).compare(newFieldValue(bv))
+		}
+		if order.Direction == firestore.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	cmp := strings.Compare(a.Ref.Path, b.Ref.Path)
+	if direction == firestore.Desc {
+		return -cmp
+	}
+	return cmp
+}
@@ -0,0 +1,135 @@
+package foon
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/** Memcacheのキーの最大長 */
+const maxMemcacheKeyLength = 250
+
+/** スキーマのフィンガープリントの長さ */
+const schemaFingerprintSize = 8
+
+var (
+	cacheVersionMutex sync.RWMutex
+	cacheVersion      = ""
+
+	// reflect.Type -> スキーマのフィンガープリント
+	schemaTypes sync.Map
+)
+
+/**
+ * アプリケーションのキャッシュバージョンを設定する
+ * バージョンが異なるインスタンス同士ではキャッシュを共有しない。起動時に1度だけ呼ぶ。
+ * 他のバージョンでの書き込みではこのバージョンのキャッシュは削除されないため、
+ * 複数バージョンを並行して動かす期間は短くすること。
+ */
+func SetCacheVersion(version string) {
+	cacheVersionMutex.Lock()
+	defer cacheVersionMutex.Unlock()
+	cacheVersion = version
+}
+
+func getCacheVersion() string {
+	cacheVersionMutex.RLock()
+	defer cacheVersionMutex.RUnlock()
+	return cacheVersion
+}
+
+/**
+ * エンティティの型を検査し、スキーマのフィンガープリントを作成しておく
+ * フィンガープリントはキャッシュのエントリに保存し、読み込む型と異なる場合はキャッシュミスとして扱う。
+ * (キャッシュキーには含めないので、Keyのみの削除や同じコレクションの別の型にも影響しない)
+ */
+func RegisterSchema(src interface{}) {
+	if _, err := newFields(src); err != nil {
+		panic(fmt.Sprintf("error is occurred (reason: %+v)", err))
+	}
+	typeFingerprint(src)
+}
+
+/** 値の型のフィンガープリント (ポインタは外した型で作成する) */
+func typeFingerprint(src interface{}) string {
+	t := reflect.TypeOf(src)
+	if t == nil {
+		return strings.Repeat("0", schemaFingerprintSize)
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if fingerprint, ok := schemaTypes.Load(t); ok {
+		return fingerprint.(string)
+	}
+	fingerprint := schemaFingerprint(t)
+	schemaTypes.Store(t, fingerprint)
+	return fingerprint
+}
+
+/** 構造体のフィールド名・型・タグからスキーマのフィンガープリントを作成する */
+func schemaFingerprint(t reflect.Type) string {
+	h := sha1.New()
+	writeSchema(h, t, map[reflect.Type]bool{})
+	return hex.EncodeToString(h.Sum(nil))[:schemaFingerprintSize]
+}
+
+func writeSchema(h hash.Hash, t reflect.Type, seen map[reflect.Type]bool) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		fmt.Fprintf(h, "%s(", t.Kind())
+		writeSchema(h, t.Elem(), seen)
+		fmt.Fprint(h, ")")
+	case reflect.Map:
+		fmt.Fprintf(h, "map[%s](", t.Key())
+		writeSchema(h, t.Elem(), seen)
+		fmt.Fprint(h, ")")
+	case reflect.Struct:
+		if seen[t] || t == timeType {
+			fmt.Fprint(h, t.String())
+			return
+		}
+		seen[t] = true
+		fmt.Fprintf(h, "%s{", t.String())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fmt.Fprintf(h, "%s %q ", field.Name, field.Tag)
+			writeSchema(h, field.Type, seen)
+			fmt.Fprint(h, ";")
+		}
+		fmt.Fprint(h, "}")
+	default:
+		fmt.Fprint(h, t.String())
+	}
+}
+
+/** キャッシュキーに付与する名前空間 (バージョン) */
+func cacheNamespace() string {
+	if version := getCacheVersion(); version != "" {
+		return fmt.Sprintf("v:%s/", version)
+	}
+	return ""
+}
+
+/** Memcacheで使えないキー(長すぎる・制御文字を含む)はハッシュ化する */
+func memcacheKey(path string) string {
+	if len(path) <= maxMemcacheKeyLength && validMemcacheKey(path) {
+		return path
+	}
+	sum := sha256.Sum256([]byte(path))
+	return "foon/hash/" + hex.EncodeToString(sum[:])
+}
+
+func validMemcacheKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package foon
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaV1 struct {
+	__kind string `foon:"collection,SchemaTest"`
+	ID     string `foon:"id"`
+	Name   string `firestore:"name"`
+}
+
+type schemaV2 struct {
+	__kind string `foon:"collection,SchemaTest"`
+	ID     string `foon:"id"`
+	Name   string `firestore:"displayName"`
+}
+
+func TestSchema_構造体が変わるとキャッシュを読み込まない(t *testing.T) {
+	assert.NotEqual(t, schemaFingerprint(reflect.TypeOf(schemaV1{})), schemaFingerprint(reflect.TypeOf(schemaV2{})))
+	assert.Equal(t, schemaFingerprint(reflect.TypeOf(schemaV1{})), schemaFingerprint(reflect.TypeOf(&schemaV1{}).Elem()))
+
+	cache := NewCache(nil, nil)
+	data, err := cache.asByte("foon/TestUser/user001", &schemaV1{ID: "a", Name: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, errSchemaMismatch, cache.asValue("foon/TestUser/user001", data, &schemaV2{}))
+	dst := &schemaV1{}
+	assert.NoError(t, cache.asValue("foon/TestUser/user001", data, dst))
+	assert.Equal(t, "name", dst.Name)
+}
+
+func TestSchema_構造体が異なるエントリは削除しない(t *testing.T) {
+	// 削除したキーはブレーカーが開いている間リトライキューに入る
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.record(errors.New("memcache is down"))
+	cache := NewCache(nil, nil)
+	cache.SetCircuitBreaker(breaker)
+	data, err := cache.asByte("foon/SchemaTest/a", &schemaV1{ID: "a", Name: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, NoSuchDocument, cache.decode("foon/SchemaTest/a", data, &schemaV2{}))
+	assert.Equal(t, int64(0), breaker.Stats().RetryPending)
+
+	// 壊れたエントリは削除する
+	assert.Equal(t, NoSuchDocument, cache.decode("foon/SchemaTest/a", data[:4], &schemaV1{}))
+	assert.Equal(t, int64(1), breaker.Stats().RetryPending)
+}
+
+func TestSchema_キャッシュキーは型に依存しない(t *testing.T) {
+	// Keyのみの削除や同じコレクションの別の型でも同じキーになる
+	RegisterSchema(&schemaV1{})
+	v1 := InstanceCache.CreateURIByKey(NewKey(&schemaV1{ID: "a"})).URI()
+	RegisterSchema(&schemaV2{})
+	v2 := InstanceCache.CreateURIByKey(NewKey(&schemaV2{ID: "a"})).URI()
+	assert.Equal(t, v1, v2)
+	assert.Equal(t, v1, InstanceCache.CreateURIByKey(&Key{Collection: "SchemaTest", ID: "a"}).URI())
+	assert.True(t, strings.HasSuffix(v1, "/SchemaTest/a"))
+}
+
+func TestSchema_バージョンがキャッシュキーに含まれる(t *testing.T) {
+	defer SetCacheVersion("")
+	SetCacheVersion("20190701")
+	uri := MetadataCache.CreateURIByKey(NewKey(&schemaV1{})).URI()
+	assert.Equal(t, "foon/metadata/v:20190701/SchemaTest", uri)
+}
+
+func TestSchema_長いキーはハッシュ化される(t *testing.T) {
+	assert.Equal(t, "foon/TestUser/a", memcacheKey("foon/TestUser/a"))
+
+	long := "foon/" + strings.Repeat("a", 300)
+	hashed := memcacheKey(long)
+	assert.True(t, len(hashed) <= maxMemcacheKeyLength)
+	assert.Equal(t, hashed, memcacheKey(long))
+	assert.NotEqual(t, hashed, memcacheKey(long+"b"))
+	assert.NotEqual(t, "foon/a b", memcacheKey("foon/a b"))
+}
@@ -0,0 +1,288 @@
+package foon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** 処理時間のヒストグラムの境界 (秒) */
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+/** キャッシュエントリのサイズのヒストグラムの境界 (バイト) */
+var entrySizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+/**
+ * コレクション毎のキャッシュとFirestoreの統計
+ * 複数のリクエストで共有するため、パッケージ変数などで1つだけ作成して使う。
+ */
+type Metrics struct {
+	mu          sync.Mutex
+	collections map[string]*CollectionStats
+}
+
+type CollectionStats struct {
+	InstanceCacheHits   int64
+	InstanceCacheMisses int64
+	QueryCacheHits      int64
+	QueryCacheMisses    int64
+	Invalidations       int64
+	FirestoreReads      int64
+	FirestoreWrites     int64
+	FirestoreDeletes    int64
+	EncodedBytes        int64
+	EntrySize           Histogram
+	// 操作(get/put/query等)毎の処理時間 (秒)
+	Latency map[string]Histogram
+}
+
+/** Countsは各境界以下の件数 (累積しない値。最後の要素は最大の境界を超えた件数) */
+type Histogram struct {
+	Buckets []float64
+	Counts  []int64
+	Count   int64
+	Sum     float64
+}
+
+/** Foon.Statsで返す統計のスナップショット */
+type Stats struct {
+	Collections map[string]CollectionStats
+	Health      CacheHealthStats
+}
+
+var defaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{collections: map[string]*CollectionStats{}}
+}
+
+/** 既定の統計 (SetMetricsで変更しない限り全てのFoonで共有する) */
+func DefaultMetrics() *Metrics {
+	return defaultMetrics
+}
+
+func newHistogram(buckets []float64) Histogram {
+	return Histogram{Buckets: buckets, Counts: make([]int64, len(buckets)+1)}
+}
+
+func (h *Histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.Buckets, value)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += value
+}
+
+func (h Histogram) clone() Histogram {
+	counts := make([]int64, len(h.Counts))
+	copy(counts, h.Counts)
+	h.Counts = counts
+	return h
+}
+
+/** nilの場合は何も記録しない */
+func (m *Metrics) update(collection string, fn func(stats *CollectionStats)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.collections[collection]
+	if !ok {
+		stats = &CollectionStats{
+			EntrySize: newHistogram(entrySizeBuckets),
+			Latency:   map[string]Histogram{},
+		}
+		m.collections[collection] = stats
+	}
+	fn(stats)
+}
+
+func (m *Metrics) instanceCache(collection string, hit bool) {
+	m.update(collection, func(stats *CollectionStats) {
+		if hit {
+			stats.InstanceCacheHits++
+		} else {
+			stats.InstanceCacheMisses++
+		}
+	})
+}
+
+func (m *Metrics) queryCache(collection string, hit bool) {
+	m.update(collection, func(stats *CollectionStats) {
+		if hit {
+			stats.QueryCacheHits++
+		} else {
+			stats.QueryCacheMisses++
+		}
+	})
+}
+
+func (m *Metrics) invalidated(collection string, count int) {
+	if count <= 0 {
+		return
+	}
+	m.update(collection, func(stats *CollectionStats) {
+		stats.Invalidations += int64(count)
+	})
+}
+
+func (m *Metrics) firestore(collection string, reads int, writes int, deletes int) {
+	m.update(collection, func(stats *CollectionStats) {
+		stats.FirestoreReads += int64(reads)
+		stats.FirestoreWrites += int64(writes)
+		stats.FirestoreDeletes += int64(deletes)
+	})
+}
+
+func (m *Metrics) encoded(collection string, size int) {
+	m.update(collection, func(stats *CollectionStats) {
+		stats.EncodedBytes += int64(size)
+		stats.EntrySize.observe(float64(size))
+	})
+}
+
+/** deferで呼び出す (startは呼び出し時に評価される) */
+func (m *Metrics) observe(collection string, operation string, start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	m.update(collection, func(stats *CollectionStats) {
+		histogram, ok := stats.Latency[operation]
+		if !ok {
+			histogram = newHistogram(latencyBuckets)
+		}
+		histogram.observe(elapsed)
+		stats.Latency[operation] = histogram
+	})
+}
+
+func (m *Metrics) Snapshot() map[string]CollectionStats {
+	res := map[string]CollectionStats{}
+	if m == nil {
+		return res
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, stats := range m.collections {
+		copied := *stats
+		copied.EntrySize = stats.EntrySize.clone()
+		copied.Latency = map[string]Histogram{}
+		for operation, histogram := range stats.Latency {
+			copied.Latency[operation] = histogram.clone()
+		}
+		res[name] = copied
+	}
+	return res
+}
+
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collections = map[string]*CollectionStats{}
+}
+
+/** 統計をPrometheusのテキスト形式で返すHandler (breakerがnilの場合は障害の統計を出力しない) */
+func MetricsHandler(metrics *Metrics, breaker *CircuitBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		stats := Stats{Collections: metrics.Snapshot()}
+		if breaker != nil {
+			stats.Health = breaker.Stats()
+		}
+		writePrometheus(w, stats, breaker != nil)
+	})
+}
+
+func writePrometheus(w io.Writer, stats Stats, health bool) {
+	names := []string{}
+	for name := range stats.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(stats CollectionStats) int64
+	}{
+		{"foon_instance_cache_hits_total", "Instance cache hits.", func(s CollectionStats) int64 { return s.InstanceCacheHits }},
+		{"foon_instance_cache_misses_total", "Instance cache misses.", func(s CollectionStats) int64 { return s.InstanceCacheMisses }},
+		{"foon_query_cache_hits_total", "Query cache hits.", func(s CollectionStats) int64 { return s.QueryCacheHits }},
+		{"foon_query_cache_misses_total", "Query cache misses.", func(s CollectionStats) int64 { return s.QueryCacheMisses }},
+		{"foon_cache_invalidations_total", "Invalidated cache entries.", func(s CollectionStats) int64 { return s.Invalidations }},
+		{"foon_firestore_reads_total", "Documents read from Firestore.", func(s CollectionStats) int64 { return s.FirestoreReads }},
+		{"foon_firestore_writes_total", "Documents written to Firestore.", func(s CollectionStats) int64 { return s.FirestoreWrites }},
+		{"foon_firestore_deletes_total", "Documents deleted from Firestore.", func(s CollectionStats) int64 { return s.FirestoreDeletes }},
+		{"foon_cache_encoded_bytes_total", "Bytes of encoded cache entries.", func(s CollectionStats) int64 { return s.EncodedBytes }},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{collection=\"%s\"} %d\n", counter.name, escapeLabel(name), counter.value(stats.Collections[name]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP foon_cache_entry_bytes Size of encoded cache entries.\n# TYPE foon_cache_entry_bytes histogram\n")
+	for _, name := range names {
+		writeHistogram(w, "foon_cache_entry_bytes", fmt.Sprintf("collection=\"%s\"", escapeLabel(name)), stats.Collections[name].EntrySize)
+	}
+
+	fmt.Fprintf(w, "# HELP foon_operation_duration_seconds Latency of foon operations.\n# TYPE foon_operation_duration_seconds histogram\n")
+	for _, name := range names {
+		latency := stats.Collections[name].Latency
+		operations := []string{}
+		for operation := range latency {
+			operations = append(operations, operation)
+		}
+		sort.Strings(operations)
+		for _, operation := range operations {
+			labels := fmt.Sprintf("collection=\"%s\",operation=\"%s\"", escapeLabel(name), escapeLabel(operation))
+			writeHistogram(w, "foon_operation_duration_seconds", labels, latency[operation])
+		}
+	}
+
+	if !health {
+		return
+	}
+	open := 0
+	if stats.Health.Open {
+		open = 1
+	}
+	gauges := []struct {
+		name  string
+		kind  string
+		help  string
+		value int64
+	}{
+		{"foon_cache_circuit_open", "gauge", "Whether the cache circuit breaker is open.", int64(open)},
+		{"foon_cache_errors_total", "counter", "Memcache errors.", stats.Health.Errors},
+		{"foon_cache_skipped_total", "counter", "Cache operations skipped while the circuit was open.", stats.Health.Skipped},
+		{"foon_cache_circuit_opened_total", "counter", "Times the cache circuit breaker opened.", stats.Health.Opened},
+		{"foon_cache_retry_pending", "gauge", "Invalidations waiting for retry.", stats.Health.RetryPending},
+		{"foon_cache_retry_queued_total", "counter", "Invalidations queued for retry.", stats.Health.RetryQueued},
+		{"foon_cache_retry_succeeded_total", "counter", "Invalidations retried successfully.", stats.Health.RetrySucceeded},
+		{"foon_cache_retry_dropped_total", "counter", "Invalidations dropped from the retry queue.", stats.Health.RetryDropped},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", gauge.name, gauge.help, gauge.name, gauge.kind, gauge.name, gauge.value)
+	}
+}
+
+func writeHistogram(w io.Writer, name string, labels string, histogram Histogram) {
+	var cumulative int64 = 0
+	for i, bound := range histogram.Buckets {
+		cumulative += histogram.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, histogram.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, histogram.Sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, histogram.Count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,70 @@
+package foon
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_コレクション毎に記録される(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.instanceCache("users", true)
+	metrics.instanceCache("users", false)
+	metrics.instanceCache("users", true)
+	metrics.queryCache("posts", false)
+	metrics.invalidated("posts", 3)
+	metrics.firestore("posts", 2, 1, 1)
+	metrics.encoded("users", 300)
+	metrics.observe("users", "get", time.Now().Add(-20*time.Millisecond))
+
+	stats := metrics.Snapshot()
+	assert.Equal(t, int64(2), stats["users"].InstanceCacheHits)
+	assert.Equal(t, int64(1), stats["users"].InstanceCacheMisses)
+	assert.Equal(t, int64(1), stats["posts"].QueryCacheMisses)
+	assert.Equal(t, int64(3), stats["posts"].Invalidations)
+	assert.Equal(t, int64(2), stats["posts"].FirestoreReads)
+	assert.Equal(t, int64(1), stats["posts"].FirestoreWrites)
+	assert.Equal(t, int64(1), stats["posts"].FirestoreDeletes)
+	assert.Equal(t, int64(300), stats["users"].EncodedBytes)
+	assert.Equal(t, []int64{0, 1, 0, 0, 0, 0, 0, 0}, stats["users"].EntrySize.Counts)
+	assert.Equal(t, int64(1), stats["users"].Latency["get"].Count)
+
+	// スナップショットは後の記録の影響を受けない
+	metrics.encoded("users", 100)
+	assert.Equal(t, int64(1), stats["users"].EntrySize.Count)
+
+	var disabled *Metrics
+	disabled.instanceCache("users", true)
+	assert.Empty(t, disabled.Snapshot())
+}
+
+func TestMetricsHandler_Prometheus形式で出力される(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.instanceCache("users", true)
+	metrics.instanceCache(`we"ird`, false)
+	metrics.observe("users", "get", time.Now())
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.enqueue([]string{"a", "b"})
+
+	server := httptest.NewServer(MetricsHandler(metrics, breaker))
+	defer server.Close()
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	text := string(body)
+
+	assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(t, text, "# TYPE foon_instance_cache_hits_total counter\n")
+	assert.Contains(t, text, `foon_instance_cache_hits_total{collection="users"} 1`+"\n")
+	assert.Contains(t, text, `foon_instance_cache_misses_total{collection="we\"ird"} 1`+"\n")
+	assert.Contains(t, text, `foon_operation_duration_seconds_bucket{collection="users",operation="get",le="+Inf"} 1`+"\n")
+	assert.Contains(t, text, `foon_operation_duration_seconds_count{collection="users",operation="get"} 1`+"\n")
+	assert.Contains(t, text, "foon_cache_retry_pending 2\n")
+	assert.Contains(t, text, "foon_cache_circuit_open 0\n")
+}
@@ -0,0 +1,175 @@
+package foon
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** RequestSummaryに保持する遅い操作の件数 */
+const maxSlowestOperations = 5
+
+/** リクエスト(Foon)内の操作のまとめ */
+type RequestSummary struct {
+	Operations  int
+	CacheHits   int64
+	CacheMisses int64
+	// Firestoreの読み込み・書き込み・削除の数
+	Cost Cost
+	// 操作の処理時間の合計
+	Elapsed time.Duration
+	// 処理時間の長い順
+	Slowest []OperationTiming
+}
+
+type OperationTiming struct {
+	Kind       OperationKind
+	Path       string
+	Conditions string
+	Documents  int
+	FromCache  bool
+	Duration   time.Duration
+}
+
+type requestSummary struct {
+	mu      sync.Mutex
+	summary RequestSummary
+}
+
+func newRequestSummary() *requestSummary {
+	return &requestSummary{summary: RequestSummary{Slowest: []OperationTiming{}}}
+}
+
+func (r *requestSummary) update(fn func(summary *RequestSummary)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.summary)
+}
+
+func (r *requestSummary) finished(timing OperationTiming) {
+	r.update(func(summary *RequestSummary) {
+		summary.Operations++
+		summary.Elapsed += timing.Duration
+		summary.Slowest = append(summary.Slowest, timing)
+		sort.SliceStable(summary.Slowest, func(i, j int) bool {
+			return summary.Slowest[i].Duration > summary.Slowest[j].Duration
+		})
+		if len(summary.Slowest) > maxSlowestOperations {
+			summary.Slowest = summary.Slowest[:maxSlowestOperations]
+		}
+	})
+}
+
+func (r *requestSummary) snapshot() RequestSummary {
+	if r == nil {
+		return RequestSummary{Slowest: []OperationTiming{}}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.summary
+	res.Slowest = append([]OperationTiming{}, r.summary.Slowest...)
+	return res
+}
+
+/** Firestoreへのリクエストを統計とリクエストのまとめに記録する */
+func (c *FirestoreCache) countFirestore(collection string, reads int, writes int, deletes int) {
+	c.metrics.firestore(collection, reads, writes, deletes)
+	c.summary.update(func(summary *RequestSummary) {
+		summary.Cost.Reads += int64(reads)
+		summary.Cost.Writes += int64(writes)
+		summary.Cost.Deletes += int64(deletes)
+	})
+}
+
+func (c *FirestoreCache) countInstanceCache(collection string, hit bool) {
+	c.metrics.instanceCache(collection, hit)
+	c.countCache(hit)
+}
+
+func (c *FirestoreCache) countQueryCache(collection string, hit bool) {
+	c.metrics.queryCache(collection, hit)
+	c.countCache(hit)
+}
+
+func (c *FirestoreCache) countCache(hit bool) {
+	c.summary.update(func(summary *RequestSummary) {
+		if hit {
+			summary.CacheHits++
+		} else {
+			summary.CacheMisses++
+		}
+	})
+}
+
+/** 操作の種類毎に、遅い操作としてログに出力する処理時間を設定する (0以下の場合は出力しない) */
+func (s *Foon) SetSlowThreshold(kind OperationKind, threshold time.Duration) {
+	thresholds := map[OperationKind]time.Duration{}
+	for k, v := range s.slowThresholds {
+		thresholds[k] = v
+	}
+	thresholds[kind] = threshold
+	s.slowThresholds = thresholds
+}
+
+/** このFoon(リクエスト)で実行した操作のまとめ */
+func (s *Foon) Summary() RequestSummary {
+	return s.cache.summary.snapshot()
+}
+
+/** リクエストのまとめをログに出力する (リクエストの最後に呼び出す) */
+func (s *Foon) LogSummary() {
+	summary := s.Summary()
+	fields := []Field{
+		F("operations", summary.Operations),
+		F("reads", summary.Cost.Reads),
+		F("writes", summary.Cost.Writes),
+		F("deletes", summary.Cost.Deletes),
+		F("index_entries", summary.Cost.IndexEntries),
+		F("cache_hits", summary.CacheHits),
+		F("cache_misses", summary.CacheMisses),
+		F("elapsed", summary.Elapsed),
+	}
+	slowest := []string{}
+	for _, timing := range summary.Slowest {
+		slowest = append(slowest, timing.Kind.String()+" "+timing.Path+" "+timing.Duration.String())
+	}
+	fields = append(fields, F("slowest", strings.Join(slowest, ", ")))
+	s.logger.Info("request summary", fields...)
+}
+
+/** 操作の結果をリクエストのまとめに記録し、閾値を超えた場合はログに出力する */
+func (s *Foon) finishOperation(op *Operation, duration time.Duration) {
+	timing := OperationTiming{
+		Kind:      op.Kind,
+		Documents: op.Documents,
+		FromCache: op.FromCache,
+		Duration:  duration,
+	}
+	if len(op.Keys) > 0 {
+		timing.Path = op.Keys[0].Path()
+		if op.Kind == QueryOperation {
+			timing.Path = op.Keys[0].CollectionPath()
+		}
+	}
+	if op.Conditions != nil {
+		timing.Conditions = strings.Replace(strings.TrimSpace(op.Conditions.String()), "\n", "; ", -1)
+	}
+	s.cache.summary.finished(timing)
+
+	threshold, ok := s.slowThresholds[op.Kind]
+	if !ok || threshold <= 0 || duration <= threshold || s.logger == nil {
+		return
+	}
+	s.logger.Warn("slow operation",
+		F("operation", op.Kind.String()),
+		F("path", timing.Path),
+		F("conditions", timing.Conditions),
+		F("documents", timing.Documents),
+		F("cache_hit", timing.FromCache),
+		F("duration", duration),
+		F("threshold", threshold))
+}
@@ -0,0 +1,60 @@
+package foon
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFoon_閾値を超えた操作はログに出力される(t *testing.T) {
+	record := &recordLogger{}
+	s := &Foon{Context: context.Background(), cache: newCache(nil, legacyLogger{record}), logger: legacyLogger{record}}
+	s.cache.SetMetrics(nil)
+	s.SetSlowThreshold(QueryOperation, time.Nanosecond)
+	s.SetSlowThreshold(GetOperation, time.Hour)
+
+	users := []TestUser{}
+	key := &Key{Collection: "users"}
+	conditions := NewConditions().Where("Name", "==", "foo")
+	s.intercept(&Operation{Kind: QueryOperation, Keys: []*Key{key}, Conditions: conditions, dst: &users}, func(s *Foon) error {
+		time.Sleep(time.Millisecond)
+		users = append(users, TestUser{}, TestUser{})
+		return nil
+	})
+	s.intercept(&Operation{Kind: GetOperation, Keys: []*Key{{Collection: "users", ID: "1"}}, dst: &TestUser{}}, func(s *Foon) error {
+		s.servedFromCache()
+		return nil
+	})
+
+	assert.Len(t, record.warnings, 1)
+	assert.True(t, strings.HasPrefix(record.warnings[0], "slow operation operation=query path=users conditions="+conditions.Queries[0].Hash()))
+	assert.Contains(t, record.warnings[0], "documents=2 cache_hit=false")
+}
+
+func TestFoon_リクエストのまとめに遅い操作が残る(t *testing.T) {
+	s := &Foon{Context: context.Background(), cache: newCache(nil, nil), logger: legacyLogger{}}
+	s.cache.SetMetrics(nil)
+	for i := 0; i < maxSlowestOperations+2; i++ {
+		wait := time.Duration(i) * time.Millisecond
+		s.intercept(&Operation{Kind: GetOperation, Keys: []*Key{{Collection: "users", ID: "1"}}}, func(s *Foon) error {
+			time.Sleep(wait)
+			return nil
+		})
+	}
+	s.cache.countFirestore("users", 3, 1, 0)
+	s.cache.countInstanceCache("users", true)
+	s.cache.countQueryCache("users", false)
+
+	summary := s.Summary()
+	assert.Equal(t, maxSlowestOperations+2, summary.Operations)
+	assert.Equal(t, int64(3), summary.Cost.Reads)
+	assert.Equal(t, int64(1), summary.Cost.Writes)
+	assert.Equal(t, int64(1), summary.CacheHits)
+	assert.Equal(t, int64(1), summary.CacheMisses)
+	assert.Len(t, summary.Slowest, maxSlowestOperations)
+	assert.True(t, summary.Slowest[0].Duration >= summary.Slowest[1].Duration)
+	assert.True(t, summary.Slowest[0].Duration >= time.Duration(maxSlowestOperations+1)*time.Millisecond)
+	assert.Equal(t, "users/1", summary.Slowest[0].Path)
+}
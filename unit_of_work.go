@@ -0,0 +1,274 @@
+package foon
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+/** 1つのバッチで書き込める件数の上限 */
+const maxBatchWrites = 500
+
+/**
+ * リクエスト内で読み込んだエンティティを追跡する (Identity Map / Unit of Work)
+ * 同じKeyのエンティティは GetTracked・GetByKeyTracked で同じポインタを返す。
+ * Get・GetByKey・GetMultiは引数のポインタを差し替えられないため、追跡しているエンティティの値をコピーする。
+ * Put・PutMulti・Insert・InsertMulti・Deleteは Flush でまとめて書き込む (Batchはそのまま書き込む)。
+ */
+type unitOfWork struct {
+	mu       sync.Mutex
+	entities map[string]interface{}
+	dirty    map[string]bool
+	created  map[string]bool
+	deleted  map[string]*Key
+	order    []string
+}
+
+func newUnitOfWork() *unitOfWork {
+	return &unitOfWork{
+		entities: map[string]interface{}{},
+		dirty:    map[string]bool{},
+		created:  map[string]bool{},
+		deleted:  map[string]*Key{},
+		order:    []string{},
+	}
+}
+
+/** Unit of Workモードを開始する (トランザクション内では使えない) */
+func (s *Foon) BeginUnitOfWork() {
+	if s.transaction || s.uow != nil {
+		return
+	}
+	s.uow = newUnitOfWork()
+}
+
+/** Unit of Workモードを終了する (Flushしていない変更は破棄する) */
+func (s *Foon) EndUnitOfWork() {
+	s.uow = nil
+}
+
+/** 追跡中のエンティティを取得する (追跡していなければnil) */
+func (s *Foon) Tracked(key *Key) interface{} {
+	if s.uow == nil {
+		return nil
+	}
+	s.uow.mu.Lock()
+	defer s.uow.mu.Unlock()
+	return s.uow.entities[key.Path()]
+}
+
+/** Getと同様に取得し、追跡しているエンティティのポインタを返す */
+func (s *Foon) GetTracked(src interface{}) (interface{}, error) {
+	key, err := KeyError(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Get(src); err != nil {
+		return nil, err
+	}
+	return s.tracked(key, src), nil
+}
+
+/** GetByKeyと同様に取得し、追跡しているエンティティのポインタを返す */
+func (s *Foon) GetByKeyTracked(key *Key, src interface{}) (interface{}, error) {
+	if err := s.GetByKey(key, src); err != nil {
+		return nil, err
+	}
+	return s.tracked(key, src), nil
+}
+
+func (s *Foon) tracked(key *Key, src interface{}) interface{} {
+	if tracked := s.Tracked(key); tracked != nil && reflect.TypeOf(tracked) == reflect.TypeOf(src) {
+		return tracked
+	}
+	return src
+}
+
+/** 変更されたエンティティがあればtrueを返す */
+func (s *Foon) HasChanges() bool {
+	if s.uow == nil {
+		return false
+	}
+	s.uow.mu.Lock()
+	defer s.uow.mu.Unlock()
+	return len(s.uow.order) > 0
+}
+
+/** Put・Insert・Deleteされたエンティティをまとめて書き込む */
+func (s *Foon) Flush() error {
+	if s.uow == nil {
+		return nil
+	}
+	s.uow.mu.Lock()
+	order := append([]string{}, s.uow.order...)
+	entities := map[string]interface{}{}
+	created := map[string]bool{}
+	deleted := map[string]*Key{}
+	for _, path := range order {
+		entities[path] = s.uow.entities[path]
+		created[path] = s.uow.created[path]
+		deleted[path] = s.uow.deleted[path]
+	}
+	s.uow.mu.Unlock()
+
+	for start := 0; start < len(order); start += maxBatchWrites {
+		end := start + maxBatchWrites
+		if end > len(order) {
+			end = len(order)
+		}
+		batch, err := s.Batch()
+		if err != nil {
+			return err
+		}
+		for _, path := range order[start:end] {
+			if key := deleted[path]; key != nil {
+				batch.Delete(key)
+			} else if created[path] {
+				batch.Create(entities[path])
+			} else {
+				batch.Set(entities[path])
+			}
+		}
+		if err := batch.Commit(); err != nil {
+			s.warningf("failed to flush entities (reason: %v)", err)
+			s.uow.clean(order[:start])
+			return err
+		}
+	}
+
+	s.uow.clean(order)
+	return nil
+}
+
+func (u *unitOfWork) get(key *Key, src interface{}, load func() error) error {
+	path := key.Path()
+	if u.isDeleted(path) {
+		return NoSuchDocument
+	}
+	if u.copyTracked(path, src) {
+		return nil
+	}
+	if err := load(); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if tracked, ok := u.entities[path]; ok && reflect.TypeOf(tracked) == reflect.TypeOf(src) {
+		// 読み込み中に他で追跡された場合はそちらに合わせる
+		reflect.ValueOf(src).Elem().Set(reflect.ValueOf(tracked).Elem())
+		return nil
+	}
+	u.entities[path] = src
+	return nil
+}
+
+func (u *unitOfWork) isDeleted(path string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.deleted[path] != nil
+}
+
+/** 追跡しているエンティティがあればsrcにコピーする */
+func (u *unitOfWork) copyTracked(path string, src interface{}) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	tracked, ok := u.entities[path]
+	if !ok || reflect.TypeOf(tracked) != reflect.TypeOf(src) {
+		return false
+	}
+	if tracked != src {
+		reflect.ValueOf(src).Elem().Set(reflect.ValueOf(tracked).Elem())
+	}
+	return true
+}
+
+/** createがtrueの場合はFlush時に新規作成する (IDがない場合は常に新規作成) */
+func (u *unitOfWork) put(s *Foon, info *fields, src interface{}, create bool) error {
+	if !info.HasUniqueID() {
+		ref := newKey(info).CreateCollectionRef(s.client.Client()).NewDoc()
+		if err := info.UpdateField(ref.ID, time.Now()); err != nil {
+			return err
+		}
+		create = true
+	}
+	path := newKey(info).Path()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if tracked, ok := u.entities[path]; ok && tracked != src && reflect.TypeOf(tracked) == reflect.TypeOf(src) && reflect.TypeOf(src).Kind() == reflect.Ptr {
+		// 追跡しているポインタの参照先も同じ値にする
+		reflect.ValueOf(tracked).Elem().Set(reflect.ValueOf(src).Elem())
+	} else {
+		u.entities[path] = src
+	}
+	delete(u.deleted, path)
+	u.markDirty(path)
+	if create {
+		u.created[path] = true
+	}
+	return nil
+}
+
+func (u *unitOfWork) delete(key *Key) {
+	path := key.Path()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.entities, path)
+	delete(u.created, path)
+	u.deleted[path] = key
+	u.markDirty(path)
+}
+
+func (u *unitOfWork) markDirty(path string) {
+	if !u.dirty[path] {
+		u.dirty[path] = true
+		u.order = append(u.order, path)
+	}
+}
+
+/** スライスの各要素を追跡し、既に追跡しているものは同じポインタに置き換える (ポインタのスライスでなければfalse) */
+func (u *unitOfWork) trackSlice(slices interface{}) bool {
+	value := reflect.Indirect(reflect.ValueOf(slices))
+	if value.Type().Elem().Kind() != reflect.Ptr {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := 0; i < value.Len(); i++ {
+		elem := value.Index(i)
+		if elem.IsNil() {
+			continue
+		}
+		key, err := KeyError(elem.Interface())
+		if err != nil || !key.HasUniqueID() {
+			continue
+		}
+		path := key.Path()
+		if tracked, ok := u.entities[path]; ok && reflect.TypeOf(tracked) == elem.Type() {
+			elem.Set(reflect.ValueOf(tracked))
+			continue
+		}
+		u.entities[path] = elem.Interface()
+	}
+	return true
+}
+
+func (u *unitOfWork) clean(paths []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cleaned := map[string]bool{}
+	for _, path := range paths {
+		cleaned[path] = true
+		delete(u.dirty, path)
+		delete(u.created, path)
+		delete(u.deleted, path)
+	}
+	order := []string{}
+	for _, path := range u.order {
+		if !cleaned[path] {
+			order = append(order, path)
+		}
+	}
+	u.order = order
+}
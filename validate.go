@@ -0,0 +1,120 @@
+package foon
+
+import (
+	"fmt"
+)
+
+/** not-inで指定できる値の上限 (Firestoreの制限) */
+const maxNotInValues = 10
+
+/**
+ * 分けて実行するクエリの数の上限 (in・array-contains-anyの値の数と!=・not-inの範囲の数の積)
+ * in・array-contains-anyは値毎に実行するので、Firestoreの値の上限を超えても指定できる。
+ */
+const maxSubqueries = 100
+
+func invalidQuery(where Where, reason string) error {
+	return fmt.Errorf("%w (column: %s, operation: %s): %s", ErrInvalidQuery, where.Column, where.Operation, reason)
+}
+
+/**
+ * Firestoreが実行時に拒否するクエリを検知する (Queryの前に自動で呼ばれる)
+ * エラーはErrInvalidQueryをラップしていて (ErrInvalidQuery.Isで判定できる)、原因のフィールドを含む。
+ */
+func (c Conditions) Validate() error {
+	disjunction := ""
+	arrayContains := ""
+	notEqual := ""
+	inequality := ""
+	hasOffset := false
+	subqueries := 1
+	for _, q := range c.Queries {
+		if _, ok := q.(Offset); ok {
+			hasOffset = true
+		}
+		where, ok := q.(Where)
+		if !ok {
+			continue
+		}
+		switch where.Operation {
+		case "==", "<", "<=", ">", ">=", "!=", "in", "not-in", "array-contains", "array-contains-any":
+		default:
+			return invalidQuery(where, "unknown operator")
+		}
+
+		if where.isList() {
+			values, ok := where.values()
+			if !ok {
+				return invalidQuery(where, "value must be a slice")
+			}
+			if len(values) == 0 {
+				return invalidQuery(where, "value must not be empty")
+			}
+			if disjunction != "" {
+				return invalidQuery(where, fmt.Sprintf("can not be combined with %s", disjunction))
+			}
+			disjunction = where.Operation
+			if where.Operation == "not-in" {
+				if err := validateNotIn(where, values); err != nil {
+					return err
+				}
+			}
+		}
+		if where.Operation == "array-contains" || where.Operation == "array-contains-any" {
+			if arrayContains != "" {
+				return invalidQuery(where, fmt.Sprintf("can not be combined with %s", arrayContains))
+			}
+			arrayContains = where.Operation
+		}
+		if where.Operation == "!=" || where.Operation == "not-in" {
+			if notEqual != "" {
+				return invalidQuery(where, fmt.Sprintf("can not be combined with %s", notEqual))
+			}
+			notEqual = where.Operation
+			if where.Value == nil {
+				return invalidQuery(where, "value must not be null")
+			}
+		}
+		if where.isInequality() {
+			if inequality != "" && inequality != where.Column {
+				return invalidQuery(where, fmt.Sprintf("inequality filters on multiple fields (%s and %s)", inequality, where.Column))
+			}
+			inequality = where.Column
+		}
+		if options := where.alternatives(); options != nil {
+			subqueries *= len(options)
+			if subqueries > maxSubqueries {
+				return invalidQuery(where, fmt.Sprintf("up to %d subqueries are allowed (got %d or more)", maxSubqueries, subqueries))
+			}
+		}
+	}
+
+	if inequality != "" && (c.hasOrder() || c.documentCursor() != nil) {
+		// OrderByがない場合はカーソルの並び順が使われる
+		if orders := c.effectiveOrders(); len(orders) > 0 && orders[0].FieldName != inequality {
+			return fmt.Errorf("%w: the first order (%s) must be on the inequality field (%s)", ErrInvalidQuery, orders[0].FieldName, inequality)
+		}
+	}
+	if hasOffset && (c.cursorQuery != nil || c.endQuery != nil) {
+		return fmt.Errorf("%w: offset can not be combined with cursors", ErrInvalidQuery)
+	}
+	return nil
+}
+
+/** not-inは範囲のクエリに分けるので、比較できる値のみ指定できる */
+func validateNotIn(where Where, values []interface{}) error {
+	if len(values) > maxNotInValues {
+		return invalidQuery(where, fmt.Sprintf("up to %d values are allowed", maxNotInValues))
+	}
+	first := newFieldValue(values[0])
+	for _, value := range values {
+		field := newFieldValue(value)
+		if field.Kind == NullKind {
+			return invalidQuery(where, "values must not contain null")
+		}
+		if _, ok := first.compare(field); !ok {
+			return invalidQuery(where, "values must be comparable")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package foon
+
+import (
+	"cloud.google.com/go/firestore"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidate_Firestoreが拒否するクエリを検知する(t *testing.T) {
+	cursor := &Cursor{ID: "cursor001", Path: "CursorTest/cursor001", Orders: []CursorOrder{{"name", firestore.Asc}}}
+	tests := []struct {
+		name       string
+		conditions *Conditions
+		// エラーメッセージに含まれる文字列 (空の場合はエラーにならない)
+		contains []string
+	}{
+		{"条件なし", NewConditions(), nil},
+		{"等号のみ", NewConditions().WhereEq("name", "a").WhereEq("num", 1).OrderBy("time", firestore.Asc), nil},
+		{"同じフィールドの範囲", NewConditions().WhereGte("num", 1).WhereLt("num", 10).OrderBy("num", firestore.Asc).OrderBy("name", firestore.Asc), nil},
+		{"範囲とOrderByなし", NewConditions().WhereGt("num", 1), nil},
+		{"複数フィールドの不等号", NewConditions().WhereGt("num", 1).WhereLt("time", 10), []string{"num", "time"}},
+		{"!=と範囲が別のフィールド", NewConditions().WhereNotEq("name", "a").WhereGt("num", 1), []string{"name", "num"}},
+		{"最初のOrderByが不等号のフィールドではない", NewConditions().WhereGt("num", 1).OrderBy("name", firestore.Asc).OrderBy("num", firestore.Asc), []string{"name", "num"}},
+		{"not-inと最初のOrderBy", NewConditions().WhereNotIn("num", []int{1}).OrderBy("name", firestore.Desc), []string{"name", "num"}},
+		{"カーソルの並び順が不等号のフィールドではない", NewConditions().WhereGt("num", 1).StartAfter(cursor), []string{"name", "num"}},
+		{"Offsetとカーソル", NewConditions().Offset(10).StartAfter(cursor), []string{"offset"}},
+		{"Offsetと値のカーソル", NewConditions().OrderBy("num", firestore.Asc).Offset(10).EndAtValues(3), []string{"offset"}},
+		{"Offsetのみ", NewConditions().OrderBy("num", firestore.Asc).Offset(10), nil},
+		{"不明な演算子", NewConditions().Where("name", "=>", "a"), []string{"name", "=>"}},
+		{"inの値がFirestoreの上限を超える", NewConditions().WhereIn("num", make([]int, 31)), nil},
+		{"array-contains-anyの値がFirestoreの上限を超える", NewConditions().Where("tags", "array-contains-any", make([]string, 31)), nil},
+		{"inの値が多すぎる", NewConditions().WhereIn("num", make([]int, maxSubqueries+1)), []string{"num", "subqueries"}},
+		{"inと!=のクエリの数", NewConditions().WhereNotEq("name", "a").WhereIn("num", make([]int, maxSubqueries/2)), nil},
+		{"inと!=のクエリが多すぎる", NewConditions().WhereIn("num", make([]int, maxSubqueries/2+1)).WhereNotEq("name", "a"), []string{"name", "subqueries"}},
+		{"array-contains-anyと!=のクエリが多すぎる", NewConditions().WhereNotEq("num", 1).Where("tags", "array-contains-any", make([]string, maxSubqueries/2+1)), []string{"tags", "subqueries"}},
+	}
+	for _, test := range tests {
+		err := test.conditions.Validate()
+		if len(test.contains) == 0 {
+			assert.NoError(t, err, test.name)
+			continue
+		}
+		if !assert.Error(t, err, test.name) {
+			continue
+		}
+		assert.True(t, errors.Is(err, ErrInvalidQuery), test.name)
+		assert.True(t, ErrInvalidQuery.Is(err), test.name)
+		for _, s := range test.contains {
+			assert.Contains(t, err.Error(), s, test.name)
+		}
+	}
+}
+
+func TestValidate_Queryの前に検証する(t *testing.T) {
+	_, err := NewConditions().WhereGt("num", 1).WhereLt("time", 10).Query(firestore.Query{}, nil)
+	assert.True(t, errors.Is(err, ErrInvalidQuery))
+}